@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 
@@ -33,10 +34,36 @@ const (
 	SSOIntegration
 	// Deletes all API Gateways
 	DeleteAllGateways
+	// DestroyExternalFunction deletes the cloud resources of an External Function
+	DestroyExternalFunction
+	// DetachSnowflakeAccount removes one Snowflake account from a shared External Function proxy
+	DetachSnowflakeAccount
+	// RepairTrust re-trusts an API integration that was recreated with a new identity
+	RepairTrust
+	// ListResources lists the resources goflake created, found by their tags
+	ListResources
+	// RotateAPIKey replaces the API key Snowflake presents to the Cloud Proxy
+	RotateAPIKey
+	// LambdaLogs prints a deployed function's recent logs
+	LambdaLogs
+	// InvokeFunction calls a Cloud Proxy directly, without Snowflake
+	InvokeFunction
+	// Doctor checks the cloud and Snowflake permissions without creating anything
+	Doctor
 )
 
+// commands can be run directly, e.g. `goflake repair-trust`, skipping the menu
+var commands = map[string]topOption{
+	"repair-trust": RepairTrust,
+	"list":         ListResources,
+	"rotate-key":   RotateAPIKey,
+	"logs":         LambdaLogs,
+	"invoke":       InvokeFunction,
+	"doctor":       Doctor,
+}
+
 func (o topOption) String() string {
-	supported := [...]string{"External Function", "SSO Integration", "Delete All Gateways"}
+	supported := [...]string{"External Function", "SSO Integration", "Delete All Gateways", "Destroy External Function", "Detach Snowflake Account", "Repair Trust", "List Resources", "Rotate API Key", "Lambda Logs", "Invoke Function", "Doctor"}
 	if int(o) > len(supported)-1 {
 		return common.NOTSUPPORTED
 	}
@@ -44,27 +71,72 @@ func (o topOption) String() string {
 }
 
 func main() {
+	var overrides externalfunction.EndpointOverrides
+	flag.StringVar(&overrides.AWSEndpointURL, "aws-endpoint-url", "", "Send every AWS request to this endpoint (e.g. http://localhost:4566 for LocalStack)")
+	flag.StringVar(&overrides.SnowflakeHost, "snowflake-host", "", "Snowflake host to connect to instead of <account>.snowflakecomputing.com")
+	flag.IntVar(&overrides.SnowflakePort, "snowflake-port", 0, "Snowflake port to connect to instead of 443")
+	flag.StringVar(&overrides.SnowflakeProtocol, "snowflake-protocol", "", "Snowflake protocol (http or https) to use instead of https")
+	specPath := flag.String("spec", "", "JSON file customising the resources goflake creates")
+	trustInvoker := flag.Bool("trust-invoker", false, "Let invoke trust you to assume the gateway role while it runs")
+	flag.Parse()
+	externalfunction.SetEndpointOverrides(overrides)
+	if *specPath != "" {
+		if err := externalfunction.LoadSpec(*specPath); err != nil {
+			log.Fatalf("Unable to load spec %s: %v\n", *specPath, err)
+		}
+	}
+
 	goterm.Clear()
 	goterm.Flush()
 	goterm.MoveCursor(1, 1)
 	goterm.Flush()
 	fmt.Print(banner)
 
-	prompt := promptui.Select{
-		Label: "What do you want make?",
-		Items: []topOption{ExternalFunction, SSOIntegration},
+	selected, found := commands[flag.Arg(0)]
+	if flag.NArg() > 0 && !found {
+		log.Fatalf("Unknown command %s\n", flag.Arg(0))
 	}
+	if !found {
+		items := []topOption{ExternalFunction, SSOIntegration, DestroyExternalFunction, DetachSnowflakeAccount, RepairTrust, ListResources, RotateAPIKey, LambdaLogs, InvokeFunction, Doctor}
+		prompt := promptui.Select{
+			Label: "What do you want make?",
+			Items: items,
+		}
 
-	idx, _, err := prompt.Run()
+		idx, _, err := prompt.Run()
 
-	if err != nil {
-		log.Fatalf("Prompt failed %v\n", err)
-		return
+		if err != nil {
+			log.Fatalf("Prompt failed %v\n", err)
+			return
+		}
+		selected = items[idx]
 	}
-	selected := topOption(idx)
 	switch selected {
 	case ExternalFunction:
 		externalfunction.Start()
+	case DestroyExternalFunction:
+		externalfunction.Destroy()
+	case DetachSnowflakeAccount:
+		externalfunction.Detach()
+	case RepairTrust:
+		externalfunction.RepairTrust()
+	case ListResources:
+		externalfunction.List()
+	case RotateAPIKey:
+		externalfunction.RotateAPIKey()
+	case LambdaLogs:
+		externalfunction.Logs()
+	case InvokeFunction:
+		// e.g. `goflake invoke 1 hello` or `goflake invoke @batch.json`
+		var args []string
+		if flag.NArg() > 1 {
+			args = flag.Args()[1:]
+		}
+		externalfunction.Invoke(args, *trustInvoker)
+	case Doctor:
+		if err := externalfunction.Doctor(); err != nil {
+			log.Fatalf("Error encountered: %s\n", err)
+		}
 	default:
 		log.Fatalf("%s is not supported at this time.\n", selected)
 	}
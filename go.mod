@@ -3,9 +3,9 @@ module github.com/tampajohn/goflake
 go 1.15
 
 require (
-	github.com/aws/aws-sdk-go v1.36.29
+	github.com/aws/aws-sdk-go v1.40.59
 	github.com/buger/goterm v0.0.0-20200322175922-2f3e71b85129
 	github.com/manifoldco/promptui v0.8.0
 	github.com/snowflakedb/gosnowflake v1.3.13
-	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 )
@@ -8,6 +8,14 @@ def lambda_handler(event, context):
     # The return value will contain an array of arrays (one inner array per input row).
     array_of_rows_to_return = [ ]
 
+    # Log Snowflake's batch id next to API Gateway's request id, which is what
+    # the stage's access logs record.
+    headers = {k.lower(): v for k, v in (event.get("headers") or {}).items()}
+    print(json.dumps({
+        "requestId": (event.get("requestContext") or {}).get("requestId"),
+        "batchId": headers.get("sf-external-function-query-batch-id"),
+    }))
+
     try:
         # From the input parameter named "event", get the body, which contains
         # the input rows.
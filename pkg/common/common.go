@@ -12,6 +12,33 @@ import (
 // NOTSUPPORTED is used to represent unsupported options
 const NOTSUPPORTED = "NOT_SUPPORTED"
 
+// Prompter asks the user questions. Terminal asks them on the terminal;
+// tests script the answers with their own Prompter.
+type Prompter interface {
+	AskYesNo(question string) bool
+	AskOptions(question string, options []string) (int, string)
+	EnvOrString(envVariable string, mask bool) string
+	PromptString(question string, mask bool, defValue string) string
+	PromptStringWithValidator(question string, mask bool, defValue string, validator func(string) error) string
+}
+
+// Terminal is the Prompter asking on the terminal.
+type Terminal struct{}
+
+func (Terminal) AskYesNo(question string) bool { return AskYesNo(question) }
+func (Terminal) AskOptions(question string, options []string) (int, string) {
+	return AskOptions(question, options)
+}
+func (Terminal) EnvOrString(envVariable string, mask bool) string {
+	return EnvOrString(envVariable, mask)
+}
+func (Terminal) PromptString(question string, mask bool, defValue string) string {
+	return PromptString(question, mask, defValue)
+}
+func (Terminal) PromptStringWithValidator(question string, mask bool, defValue string, validator func(string) error) string {
+	return PromptStringWithValidator(question, mask, defValue, validator)
+}
+
 func AskYesNo(question string) bool {
 	prompt := promptui.Select{
 		Label: question,
@@ -1,19 +1,20 @@
 package externalfunction
 
 import (
-	"encoding/base64"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -26,14 +27,21 @@ type AWSConfig struct {
 	accessKeyID      string
 	secretAccessKey  string
 	region           string
+	partition        string
+	dnsSuffix        string
 	Resources        *AWSResources
 	extFuncName      string
 	extFuncSignature string
+	prompt           common.Prompter
+
+	apiExternalID string
+	iamUserARN    string
 }
 
 type AWSResources struct {
 	lambdaFuncName         string
 	lambdaFuncARN          string
+	lambdaAlias            string
 	lambdaPolicyName       string
 	lambdaRoleName         string
 	lambdaRoleARN          string
@@ -49,187 +57,220 @@ type AWSResources struct {
 	gatewayRootResource    string
 	gatewayDeploymentID    string
 	gatewayStage           string
+	gatewayPrivate         bool
+	gatewayVpcEndpointIDs  []string
+	gatewayAPIKeyRequired  bool
+	gatewayAPIKeyID        string
+	gatewayAPIKey          string
 	lambdaFunctionZipBytes []byte
+	lambdaPackageType      string
+	lambdaImageURI         string
+	lambdaS3Bucket         string
+	lambdaS3Key            string
+	lambdaS3Version        string
 	regionConfig           *aws.Config
 }
 
 const (
-	LambdaZip     = `UEsDBBQAAAAIAIOOO1J7JNvACAMAAJ0HAAASABwAbGFtYmRhX2Z1bmN0aW9uLnB5VVQJAAOW7hFgDDQUYHV4CwABBPUBAAAEFAAAAJVVTWvcMBC9768Y3ENsWExaelrIIYSEtoc0pEsvy2JkezZWaktGkpMsIf+9M5K9/khL6bJgWzN682beaCSbVhsHj1ar1arEA9SiyUuRVUKVNZoYn1C5NRRaOXxxyWa1Avp9gE/n5yAtuArhy3Z7B9YJ11nyKxEO2kCkf0Wp9w2WzFsueN8AsaW9Bl1nFDyJukN4lnXtIwmpQNDfGHEEfQgvFmKtEKRSaHpTS29StZ0Do5+TEM5bMn3IaMlmTmd9iAvYwT6Edua48S+Bx43RjU8kQLXCiAYdQSt6lhD5EkRreEDn3XJdHtfwXMmiGtjaCdyIxAzSk8XDZLyZuPiPXcRfUc8q7L7S6gmNm6AcmJ6Abz++31ItjVQPZHB6WNL5IxZuDNOKY61FSTFY05TfbTzGTiaxthUpSP9cWFmIuj7+oeipl2la9CFlpjgBo2RBdU2OZk0wJdELonIzoKBSjXVthbVUWMqBszx0qnCSqJ7AuG7Ev89kF5XCiXmVbgbQU6HpzaNNa5KOkMyi92L0UX4Pd49UsJlufSoQ86ru3GLZd2qOfo+lrJJ0CsieWe95wR+78/3JPnNkvekA2oDUxyE5qDpajYzSIJWVTVsj4Ivg5wKoQYOkIBaVRjtJJmfF6prqwZ3D614X2zfRILirhFsgnpI0KBwxEpZEtYRCHH5e3n+9vN0GrHnyIYssqE+nLromSqFrad1uov3MffbBMkkvklAPGNeoYi7fx80+SWaavYuUirZFVXp3uU9Wi1zuunCkwjCgZCZicrfObIH6rD7v9Z1NllHw9YzVfsmDejKcjrL0JR+qH45C4wff+3h/mWmTnMfFSeo8AGjuNq1wMq8xC9NjxtzPiLJrWhu/hnMGm7+Fe+uh8aXA1sG1f9DB5cZAY6Yj9TPfDtSkkvrM6oZ66NgiDxXy02ZMbn430K7pdEK+DWgs8XnjUjk+A8O0oKbu6hKUdhCuqvR/0h7n4XAZ3QeTW95JLNbygguherfXU9yz4HJFHmebaWrr0YVDkvFfFP2Gt9VvUEsBAh4DFAAAAAgAg447Unsk28AIAwAAnQcAABIAGAAAAAAAAQAAAKSBAAAAAGxhbWJkYV9mdW5jdGlvbi5weVVUBQADlu4RYHV4CwABBPUBAAAEFAAAAFBLBQYAAAAAAQABAFgAAABUAwAAAAA=`
-	TrustDocument = `{
-		"Version": "2012-10-17",
-		"Statement": {
-		  "Effect": "Allow",
-		  "Principal": {"Service": "lambda.amazonaws.com"},
-		  "Action": "sts:AssumeRole"
-		}
-	  }`
-
-	ApiResourcePolicy = `{
-		"Version": "2012-10-17",
-		"Statement": [
-			{
-				"Effect": "Allow",
-				"Principal": {
-					"AWS": "arn:aws:sts::%s:assumed-role/%s/snowflake"
-				},
-				"Action": "execute-api:Invoke",
-				"Resource": "arn:aws:execute-api:%s:%s:%s/*"
-			}
-		]
-	}`
-
-	ExternalApiRoleTrustDocument = `{
-		"Version": "2012-10-17",
-		"Statement":
-		[
-			{
-			"Effect": "Allow",
-			"Principal":
-				{
-				"AWS": "%s"
-				},
-			"Condition": {
-				"StringEquals": {
-					"sts:ExternalId": "%s"
-				}
-			},
-			"Action": "sts:AssumeRole"
-			}
-		]
-	}`
-
-	InvokeExternalApiPolicyDocument = `{
-		"Version": "2012-10-17",
-		"Statement": [
-			{
-				"Effect": "Allow",
-				"Action": [
-					"execute-api:Invoke"
-				],
-				"Resource": "arn:aws:execute-api:%s:%s:%s/*"
-			}
-		]
-	}`
-
-	BasicRoleTemplate = `{
-		"Version": "2012-10-17",
-		"Statement": [
-		  {
-			"Effect": "Allow",
-			"Action": [
-			  "logs:CreateLogGroup",
-			  "logs:CreateLogStream",
-			  "logs:PutLogEvents"
-			],
-			"Resource": "arn:aws:logs:*:*:*"
-		  }
-		]
-	  }
-	  `
+	LambdaZip = `UEsDBBQAAAAIAIOOO1IHg2rhvgMAABIJAAASAAAAbGFtYmRhX2Z1bmN0aW9uLnB5lVbfa+M4EH7PXzF4H2pDYrrHPgX6UJb90ePYK91wLyUYxZ4kam3JK8lNQ+n/vjOSHNvpleNCILZm9M3M941GkU2rjYMHq9VsVuEWatFsKlHshapqNCk+oXJzKLVy+Oyy5WwG9PkAf1xegrTg9gjfV6tbsE64zpJfhbDVBhL9mOTeN1gKb7nifT3EivYadJ1R8CTqDuEg69pHElKBoK8x4gh6Gx4spFohSKXQRFNLT1K1nQOjD1kI5y2F3ha0ZAunixjiCu5h3Yf+S+/gp9KHbS0e8cLCRrhyD7ICRUWC03B9ewPfhMODOJLZ4K8OrSOHORz2kl0tPQgX4ZgFKnPHUKIs0Vqo9Y73ldpUIa89igqNpTxeHvNaH4jbbAlPnqzHOT1QzYHtfIcuTaJ/kgE5vLxmuXTY2DR79WitkcqlrFpedU1r0xe/zJ8kZntTJcsJYlz/HKQcgMdG2pTNByjPiweK6QRnu10QAhol6sW2U6WTWi1ovzku/I6FPMG8Zlkg3Znj8gT8Ab4a3Xjegn6tMKJBggRFvxUkPu9kDhTPu210dezJjy1iR3ADEsuenywepuDNRLx/uU/4LYmtEHYTJU9o3Ahly+kJ+PPn3z9IWSJ7Rwbqi7ikNw9YuiFMK461FhXF8JLws02H2Nko1mpPvSO55awsRV0f/6XTc382xp3el8wpjsCoWFBds0EzJ5iK0gsniZsKBVE18NoKa4lYqoGr7FUbSmDeKP9YyX1SCSemLH3tQU9Ec88y2piTfIDkLKIXow/ye7g76qipbrEUSHlVd+5s2Y+HDYbTRlVl+RiQPYvoecUv95frk33iyHrT1LMBKcYhOYgdrYaM8iCVlU1bI+Cz4N8zoAYNkoJY7jXaUTEbVqyuiQ/uHF73utjYRL3grh8hA+KpSIM0fkhRmiiUg9pRDv9c391c/1gFrGnxoYoiqE+jLvlCKYWupXW7TNYT98kLyyS9SELtMK1RpUzfx+U6yyaavYmUi7ZFVXl3uc5mZ7XcduFIhQlMxYzE5G6d2ELqE37e6jsZ54Pg80lW6/M8qCfD6agqT3nPfjgKjb9t3sZ75yIZ1TwsjkrnAUCXXdMKJzc1FmF6TDIfj+1wzmD5XrjXCI3PJbYOvvgfOrjcGGjMeKR+4iuZmlRSn1ndUA8dW+ShQn7aDMVNL2TaNZ5OyFcwjSU+b0yV4zPQTwtq6q6mS1I7CP8P8v9T9jAP+2v4Lpjc+R8BFuv8X0UIFd2G2+4iuHwmj4vluLThFrvgkGT8rxTDfTX7DVBLAQIUAxQAAAAIAIOOO1IHg2rhvgMAABIJAAASAAAAAAAAAAAAAACkgQAAAABsYW1iZGFfZnVuY3Rpb24ucHlQSwUGAAAAAAEAAQBAAAAA7gMAAAAA`
 )
 
-func NewAWSConfig(extFuncName string, extFuncSignature string) (*AWSConfig, error) {
-	cfg := &AWSConfig{Resources: &AWSResources{}}
+// NewAWSProvider returns an unplanned AWS provider.
+func NewAWSProvider(prompt common.Prompter) Provider {
+	return &AWSConfig{prompt: prompt, Resources: &AWSResources{}}
+}
+
+// Plan gathers credentials and the names of the lambda, gateway and roles.
+func (cfg *AWSConfig) Plan(extFuncName string, extFuncSignature string) error {
 	cfg.extFuncName = extFuncName
 	cfg.extFuncSignature = extFuncSignature
 
-	if common.AskYesNo("Would you like to us to attempt to use your AWS_ACCESS_KEY_ID from your environment?") {
-		// Attempt to get the aws creds from ENV; fail back to prompting the user
-		cfg.accessKeyID = common.EnvOrString("AWS_ACCESS_KEY_ID", false)
-		cfg.secretAccessKey = common.EnvOrString("AWS_SECRET_ACCESS_KEY", true)
-		cfg.region = common.EnvOrString("AWS_DEFAULT_REGION", false)
-	} else {
-		// Just get the creds from the user
-		cfg.accessKeyID = common.PromptString("AWS_ACCESS_KEY_ID", false, "")
-		cfg.secretAccessKey = common.PromptString("AWS_SECRET_ACCESS_KEY", true, "")
-		cfg.region = common.PromptString("AWS_DEFAULT_REGION", false, "")
-	}
-
-	// set AWS env variables in this proc
-	os.Setenv("AWS_ACCESS_KEY_ID", cfg.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", cfg.secretAccessKey)
-	os.Setenv("AWS_DEFAULT_REGION", cfg.region)
-
-	cfg.Resources.regionConfig = &aws.Config{Region: &cfg.region}
-
-	sess, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewEnvCredentials(),
-	})
-
+	err := cfg.Connect()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	cfg.awsSession = sess
-	cfg.extFuncName = extFuncName
-	cfg.Resources.lambdaRoleName = common.PromptString(
+	cfg.Resources.lambdaRoleName = cfg.prompt.PromptString(
 		"What would you like the lambda role to be named?",
 		false,
 		extFuncName+"-lambda-role")
-	cfg.Resources.lambdaFuncName = common.PromptString(
+	cfg.Resources.lambdaFuncName = cfg.prompt.PromptString(
 		"What would you like the lambda to be named?",
 		false,
 		extFuncName+"-lambda")
-	cfg.Resources.gatewayName = common.PromptString(
+	cfg.Resources.gatewayName = cfg.prompt.PromptString(
 		"What would you like the api gateway to be named?",
 		false,
 		extFuncName+"-gateway")
-	cfg.Resources.lambdaPolicyName = common.PromptString(
+	cfg.Resources.lambdaPolicyName = cfg.prompt.PromptString(
 		"What would you like the lambda policy to be named?",
 		false,
 		extFuncName+"-lambda-policy")
-	cfg.Resources.lambdaRuntime = common.PromptString(
-		"What lambda runtime would you like to use?",
-		false,
-		lambda.RuntimePython38)
-	cfg.Resources.gatewayPolicyName = common.PromptString(
+	cfg.Resources.gatewayPolicyName = cfg.prompt.PromptString(
 		"What would you like the gateway policy to be named?",
 		false,
 		extFuncName+"-gateway-policy")
-	cfg.Resources.gatewayRoleName = common.PromptString(
+	cfg.Resources.gatewayRoleName = cfg.prompt.PromptString(
 		"What would you like the gateway role to be named?",
 		false,
 		extFuncName+"-gateway-role")
-	cfg.Resources.gatewayStage = common.PromptString(
+	stage := spec.Gateway.Stage.Name
+	if stage == "" {
+		stage = "prod"
+	}
+	cfg.Resources.gatewayStage = cfg.prompt.PromptString(
 		"What would you like the gateway stage to be named?",
 		false,
-		"prod")
+		stage)
+	cfg.Resources.gatewayPrivate = cfg.prompt.AskYesNo("Would you like the api gateway to be private (only reachable through VPC endpoints)?")
+	if cfg.Resources.gatewayPrivate {
+		ids := cfg.prompt.PromptString(
+			"What VPC endpoint ids (comma separated) should be allowed to call the api gateway?",
+			false,
+			"")
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				cfg.Resources.gatewayVpcEndpointIDs = append(cfg.Resources.gatewayVpcEndpointIDs, id)
+			}
+		}
+	}
 
-	if common.AskYesNo("Would you like to use the default lambda function?") {
-		cfg.Resources.lambdaHandler = "lambda_function.lambda_handler"
+	cfg.Resources.gatewayAPIKeyRequired = cfg.prompt.AskYesNo("Would you like Snowflake to present an API key (with a usage plan) to the api gateway?")
 
-		functionData, err := base64.StdEncoding.DecodeString(LambdaZip)
-		if err != nil {
-			return nil, err
-		}
+	return cfg.planLambdaCode()
+}
 
-		cfg.Resources.lambdaFunctionZipBytes = functionData
+// Connect gathers credentials and the region and opens the AWS session.
+func (cfg *AWSConfig) Connect() error {
+	if cfg.prompt.AskYesNo("Would you like to us to attempt to use your AWS_ACCESS_KEY_ID from your environment?") {
+		// Attempt to get the aws creds from ENV; fail back to prompting the user
+		cfg.accessKeyID = cfg.prompt.EnvOrString("AWS_ACCESS_KEY_ID", false)
+		cfg.secretAccessKey = cfg.prompt.EnvOrString("AWS_SECRET_ACCESS_KEY", true)
+		cfg.region = cfg.prompt.EnvOrString("AWS_DEFAULT_REGION", false)
 	} else {
-		zipPath := common.PromptStringWithValidator("What is the path of the zip file you'd like to use?", false, "", func(p string) error {
-			info, err := os.Stat(p)
-			if os.IsNotExist(err) {
-				return err
-			}
-			if info.IsDir() {
-				return fmt.Errorf("This is a directory, not a file")
-			}
-			return nil
-		})
-		f, err := os.Open(zipPath)
-		defer f.Close()
-		if err != nil {
-			return cfg, err
-		}
-		bytes, err := ioutil.ReadAll(f)
-		if err != nil {
-			return cfg, err
-		}
-		handler := common.PromptString("What is the handler for your lambda function (format is {filename}.{handler function})?", false, "lambda_function.lambda_handler")
-		cfg.Resources.lambdaHandler = handler
-		cfg.Resources.lambdaFunctionZipBytes = bytes
+		// Just get the creds from the user
+		cfg.accessKeyID = cfg.prompt.PromptString("AWS_ACCESS_KEY_ID", false, "")
+		cfg.secretAccessKey = cfg.prompt.PromptString("AWS_SECRET_ACCESS_KEY", true, "")
+		cfg.region = cfg.prompt.PromptString("AWS_DEFAULT_REGION", false, "")
+	}
+
+	// set AWS env variables in this proc
+	os.Setenv("AWS_ACCESS_KEY_ID", cfg.accessKeyID)
+	os.Setenv("AWS_SECRET_ACCESS_KEY", cfg.secretAccessKey)
+	os.Setenv("AWS_DEFAULT_REGION", cfg.region)
+
+	cfg.Resources.regionConfig = &aws.Config{Region: &cfg.region}
+	cfg.partition, cfg.dnsSuffix = awsPartition(cfg.region)
+
+	sessCfg := &aws.Config{
+		Credentials: credentials.NewEnvCredentials(),
+	}
+	if overrides.AWSEndpointURL != "" {
+		sessCfg.Endpoint = aws.String(overrides.AWSEndpointURL)
+		sessCfg.S3ForcePathStyle = aws.Bool(true)
 	}
+	sess, err := session.NewSession(sessCfg)
+
+	if err != nil {
+		return err
+	}
+
+	cfg.awsSession = sess
+	return nil
+}
+
+// awsPartition returns the partition (aws, aws-us-gov, aws-cn, ...) and DNS
+// suffix of the region, falling back to the commercial partition.
+func awsPartition(region string) (partition string, dnsSuffix string) {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID(), p.DNSSuffix()
+	}
+	return endpoints.AwsPartitionID, "amazonaws.com"
+}
+
+// consoleHost is the AWS console of the partition.
+func consoleHost(partition string) string {
+	switch partition {
+	case endpoints.AwsUsGovPartitionID:
+		return "console.amazonaws-us-gov.com"
+	case endpoints.AwsCnPartitionID:
+		return "console.amazonaws.cn"
+	}
+	return "console.aws.amazon.com"
+}
+
+// arn builds an ARN in the configured partition.
+func (cfg *AWSConfig) arn(service string, region string, account string, resource string) string {
+	return fmt.Sprintf("arn:%s:%s:%s:%s:%s", cfg.partition, service, region, account, resource)
+}
+
+// gatewayExecuteARN matches every stage, method and path of the REST API.
+func (cfg *AWSConfig) gatewayExecuteARN() string {
+	return cfg.arn("execute-api", cfg.region, cfg.awsAccount, cfg.Resources.gatewayID+"/*")
+}
+
+// snowflakeSessionARN is the assumed role session Snowflake calls the API as.
+func (cfg *AWSConfig) snowflakeSessionARN() string {
+	return cfg.arn("sts", "", cfg.awsAccount, fmt.Sprintf("assumed-role/%s/snowflake", cfg.Resources.gatewayRoleName))
+}
+
+// invokerSessionARN is the assumed role session direct invocations call the
+// API as.
+func (cfg *AWSConfig) invokerSessionARN() string {
+	return cfg.arn("sts", "", cfg.awsAccount, fmt.Sprintf("assumed-role/%s/%s", cfg.Resources.gatewayRoleName, InvokerSessionName))
+}
+
+// restAPIARN identifies the REST API itself, e.g. for tagging.
+func (cfg *AWSConfig) restAPIARN(apiID string) string {
+	return cfg.arn("apigateway", cfg.region, "", "/restapis/"+apiID)
+}
+
+// Tag keys goflake sets on every AWS resource it creates, next to the spec's
+// tags, so that it can find them again.
+const (
+	FunctionTagKey = "goflake:function"
+	VersionTagKey  = "goflake:version"
+	// StageTagKey tags the REST API with the stage Snowflake calls.
+	StageTagKey = "goflake:stage"
+)
+
+// tags are the spec's tags plus goflake's own.
+func (cfg *AWSConfig) tags() map[string]*string {
+	tags := map[string]*string{}
+	for key, value := range spec.Tags {
+		tags[key] = aws.String(value)
+	}
+	tags[FunctionTagKey] = aws.String(cfg.extFuncName)
+	tags[VersionTagKey] = aws.String(Version)
+	return tags
+}
+
+// restAPITags are the tags of the REST API, which also record its stage.
+func (cfg *AWSConfig) restAPITags() map[string]*string {
+	tags := cfg.tags()
+	tags[StageTagKey] = aws.String(cfg.Resources.gatewayStage)
+	return tags
+}
+
+// iamTags are tags in the form IAM takes them.
+func (cfg *AWSConfig) iamTags() []*iam.Tag {
+	var tags []*iam.Tag
+	for key, value := range cfg.tags() {
+		tags = append(tags, &iam.Tag{Key: aws.String(key), Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return *tags[i].Key < *tags[j].Key
+	})
+	return tags
+}
 
-	return cfg, nil
+// tagRole brings the tags of a role created by an earlier run up to date.
+func (cfg *AWSConfig) tagRole(i *iam.IAM, roleName string) error {
+	_, err := i.TagRole(&iam.TagRoleInput{
+		RoleName: aws.String(roleName),
+		Tags:     cfg.iamTags(),
+	})
+	return err
 }
 
 func APIARN(apiID *string, functionARN *string, functionName *string) string {
@@ -241,22 +282,43 @@ func APIARN(apiID *string, functionARN *string, functionName *string) string {
 
 func (cfg *AWSConfig) CreateLambdaRole(a *iam.IAM) error {
 	roleInput := &iam.CreateRoleInput{
-		RoleName:                 aws.String(cfg.Resources.lambdaRoleName),
-		AssumeRolePolicyDocument: aws.String(TrustDocument),
+		RoleName: aws.String(cfg.Resources.lambdaRoleName),
+		Tags:     cfg.iamTags(),
+	}
+	trust, err := LambdaTrustPolicy().JSON()
+	if err != nil {
+		return err
 	}
-	if common.AskYesNo("Do you wish to include a Permission Boundary?") {
-		permissionBoundary := common.PromptString("What is the ARN of the boundary you'd like to attach to this role?", false, "")
+	roleInput.AssumeRolePolicyDocument = aws.String(trust)
+	if cfg.prompt.AskYesNo("Do you wish to include a Permission Boundary?") {
+		permissionBoundary := cfg.prompt.PromptString("What is the ARN of the boundary you'd like to attach to this role?", false, "")
 		roleInput.SetPermissionsBoundary(permissionBoundary)
 	}
-	_, err := a.CreateRole(roleInput)
+	_, err = a.CreateRole(roleInput)
 
-	if err == nil {
+	switch {
+	case err == nil:
 		fmt.Println("Waiting 15s for role to propagate")
 		time.Sleep(15 * time.Second)
+	case isAWSErrorCode(err, iam.ErrCodeEntityAlreadyExistsException):
+		err = cfg.tagRole(a, cfg.Resources.lambdaRoleName)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
 	}
 
+	pd, err := LambdaExecutionPolicy(cfg.lambdaLogGroupARN(), LambdaPermissions{
+		KMSKeyARN: spec.Lambda.KMSKeyARN,
+		VPC:       spec.Lambda.VPC != nil,
+		XRay:      spec.Lambda.TracingMode == lambda.TracingModeActive,
+	}).JSON()
+	if err != nil {
+		return err
+	}
 	putParams := &iam.PutRolePolicyInput{
-		PolicyDocument: aws.String(BasicRoleTemplate),
+		PolicyDocument: aws.String(pd),
 		PolicyName:     aws.String(cfg.Resources.lambdaPolicyName),
 		RoleName:       aws.String(cfg.Resources.lambdaRoleName),
 	}
@@ -265,9 +327,24 @@ func (cfg *AWSConfig) CreateLambdaRole(a *iam.IAM) error {
 	if err != nil {
 		return err
 	}
+
+	for _, policyARN := range spec.Lambda.ManagedPolicyARNs {
+		_, err = a.AttachRolePolicy(&iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(policyARN),
+			RoleName:  aws.String(cfg.Resources.lambdaRoleName),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// lambdaLogGroupARN is the log group lambda writes the function's logs to.
+func (cfg *AWSConfig) lambdaLogGroupARN() string {
+	return cfg.arn("logs", cfg.region, cfg.awsAccount, "log-group:"+cfg.lambdaLogGroup())
+}
+
 func (cfg *AWSConfig) SetCurrentAccountID() error {
 	s := sts.New(cfg.awsSession)
 	id, err := s.GetCallerIdentity(&sts.GetCallerIdentityInput{})
@@ -279,42 +356,82 @@ func (cfg *AWSConfig) SetCurrentAccountID() error {
 	return nil
 }
 
+// CreateOrConfigureLambdaFunc creates the lambda, or brings an existing one's
+// code and configuration in line with the plan and the spec, then lets the
+// REST API invoke it.
 func (cfg *AWSConfig) CreateOrConfigureLambdaFunc(a *iam.IAM) error {
 	lrole, err := a.GetRole(&iam.GetRoleInput{
 		RoleName: aws.String(cfg.Resources.lambdaRoleName),
 	})
+	if err != nil {
+		return err
+	}
 
 	cfg.Resources.lambdaRoleARN = *lrole.Role.Arn
 	l := lambda.New(cfg.awsSession, cfg.Resources.regionConfig)
 
-	lf, err := l.CreateFunction(&lambda.CreateFunctionInput{
+	code, err := cfg.lambdaCode()
+	if err != nil {
+		return err
+	}
+	input := &lambda.CreateFunctionInput{
 		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
 		Role:         aws.String(cfg.Resources.lambdaRoleARN),
-		Runtime:      aws.String(cfg.Resources.lambdaRuntime),
-		Handler:      aws.String(cfg.Resources.lambdaHandler),
-		Code: &lambda.FunctionCode{
-			ZipFile: cfg.Resources.lambdaFunctionZipBytes,
-		},
-	})
-
-	// Will not recreate the lambda function
-	if err != nil &&
-		err.(awserr.Error).Code() != lambda.ErrCodeResourceConflictException {
-		return err
+		PackageType:  aws.String(cfg.Resources.lambdaPackageType),
+		Code:         code,
+		Tags:         cfg.tags(),
 	}
-	if lf != nil {
-		cfg.Resources.lambdaFuncARN = *lf.FunctionArn
+	// Images bring their own runtime and entry point
+	if cfg.Resources.lambdaPackageType != lambda.PackageTypeImage {
+		input.Runtime = aws.String(cfg.Resources.lambdaRuntime)
+		input.Handler = aws.String(cfg.Resources.lambdaHandler)
 	}
-	if err != nil {
-		lf2, err := l.GetFunction(&lambda.GetFunctionInput{
-			FunctionName: aws.String(cfg.Resources.lambdaFuncName),
-		})
+	if spec.Lambda.MemorySize != 0 {
+		input.MemorySize = aws.Int64(spec.Lambda.MemorySize)
+	}
+	if spec.Lambda.Timeout != 0 {
+		input.Timeout = aws.Int64(spec.Lambda.Timeout)
+	}
+	if len(spec.Lambda.Environment) > 0 {
+		input.Environment = &lambda.Environment{Variables: aws.StringMap(spec.Lambda.Environment)}
+	}
+	if len(spec.Lambda.Layers) > 0 {
+		input.Layers = aws.StringSlice(spec.Lambda.Layers)
+	}
+	if spec.Lambda.KMSKeyARN != "" {
+		input.KMSKeyArn = aws.String(spec.Lambda.KMSKeyARN)
+	}
+	if spec.Lambda.TracingMode != "" {
+		input.TracingConfig = &lambda.TracingConfig{Mode: aws.String(spec.Lambda.TracingMode)}
+	}
+	if spec.Lambda.VPC != nil {
+		input.VpcConfig = &lambda.VpcConfig{
+			SubnetIds:        aws.StringSlice(spec.Lambda.VPC.SubnetIDs),
+			SecurityGroupIds: aws.StringSlice(spec.Lambda.VPC.SecurityGroupIDs),
+		}
+	}
+	if spec.Lambda.Architecture != "" {
+		input.Architectures = aws.StringSlice([]string{spec.Lambda.Architecture})
+	}
+	lf, err := l.CreateFunction(input)
 
+	switch {
+	case err == nil:
+		cfg.Resources.lambdaFuncARN = *lf.FunctionArn
+	case isAWSErrorCode(err, lambda.ErrCodeResourceConflictException):
+		err = cfg.updateLambdaFunc(l, input)
 		if err != nil {
 			return err
 		}
-		cfg.Resources.lambdaFuncARN = *lf2.Configuration.FunctionArn
+	default:
+		return err
+	}
+
+	err = cfg.configureLambdaConcurrency(l)
+	if err != nil {
+		return err
 	}
+
 	permissionsInput := &lambda.AddPermissionInput{
 		Action:       aws.String("lambda:InvokeFunction"),
 		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
@@ -325,37 +442,283 @@ func (cfg *AWSConfig) CreateOrConfigureLambdaFunc(a *iam.IAM) error {
 			APIARN(aws.String(cfg.Resources.gatewayID), aws.String(cfg.Resources.lambdaFuncARN), aws.String(cfg.Resources.lambdaFuncName)),
 			cfg.Resources.gatewayMethod)),
 	}
+	if cfg.Resources.lambdaAlias != "" {
+		permissionsInput.Qualifier = aws.String(cfg.Resources.lambdaAlias)
+	}
 	_, err = l.AddPermission(permissionsInput)
 
-	if err != nil {
+	// The permission survives from a previous run
+	if err != nil && !isAWSErrorCode(err, lambda.ErrCodeResourceConflictException) {
 		return err
 	}
 
 	return nil
 }
 
+// updateLambdaFunc applies the code and configuration of input to the
+// existing lambda. Lambda rejects changes while a previous update is still in
+// progress, so each step waits for the function to settle.
+func (cfg *AWSConfig) updateLambdaFunc(l *lambda.Lambda, input *lambda.CreateFunctionInput) error {
+	fmt.Printf("Updating lambda %s\n", cfg.Resources.lambdaFuncName)
+	settled := &lambda.GetFunctionConfigurationInput{FunctionName: input.FunctionName}
+
+	lf, err := l.UpdateFunctionCode(&lambda.UpdateFunctionCodeInput{
+		FunctionName:    input.FunctionName,
+		ZipFile:         input.Code.ZipFile,
+		S3Bucket:        input.Code.S3Bucket,
+		S3Key:           input.Code.S3Key,
+		S3ObjectVersion: input.Code.S3ObjectVersion,
+		ImageUri:        input.Code.ImageUri,
+		Architectures:   input.Architectures,
+	})
+	if err != nil {
+		return err
+	}
+	cfg.Resources.lambdaFuncARN = *lf.FunctionArn
+	err = l.WaitUntilFunctionUpdated(settled)
+	if err != nil {
+		return err
+	}
+
+	update := &lambda.UpdateFunctionConfigurationInput{
+		FunctionName:  input.FunctionName,
+		Role:          input.Role,
+		Runtime:       input.Runtime,
+		Handler:       input.Handler,
+		MemorySize:    input.MemorySize,
+		Timeout:       input.Timeout,
+		Environment:   input.Environment,
+		Layers:        input.Layers,
+		KMSKeyArn:     input.KMSKeyArn,
+		TracingConfig: input.TracingConfig,
+		VpcConfig:     input.VpcConfig,
+	}
+	_, err = l.UpdateFunctionConfiguration(update)
+	if err != nil {
+		return err
+	}
+	err = l.WaitUntilFunctionUpdated(settled)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.TagResource(&lambda.TagResourceInput{
+		Resource: aws.String(cfg.Resources.lambdaFuncARN),
+		Tags:     cfg.tags(),
+	})
+	return err
+}
+
+// LambdaAlias is the alias provisioned concurrency is configured on; the REST
+// API invokes it instead of $LATEST.
+const LambdaAlias = "goflake"
+
+// Tags recording the concurrency goflake set on the lambda, so that once it
+// is dropped from the spec only what goflake set is removed.
+const (
+	ReservedConcurrencyTagKey    = "goflake:reserved-concurrency"
+	ProvisionedConcurrencyTagKey = "goflake:provisioned-concurrency"
+)
+
+// configureLambdaConcurrency applies the spec's reserved concurrency and, for
+// provisioned concurrency, publishes the current code as a version behind
+// LambdaAlias. Concurrency goflake set is removed from the lambda once it is
+// removed from the spec; concurrency set by anyone else is left alone.
+func (cfg *AWSConfig) configureLambdaConcurrency(l *lambda.Lambda) error {
+	fn, err := l.GetFunction(&lambda.GetFunctionInput{
+		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+	})
+	if err != nil {
+		return err
+	}
+
+	if spec.Lambda.ReservedConcurrency != nil {
+		_, err := l.PutFunctionConcurrency(&lambda.PutFunctionConcurrencyInput{
+			FunctionName:                 aws.String(cfg.Resources.lambdaFuncName),
+			ReservedConcurrentExecutions: spec.Lambda.ReservedConcurrency,
+		})
+		if err != nil {
+			return err
+		}
+		err = cfg.tagLambda(l, ReservedConcurrencyTagKey, strconv.FormatInt(*spec.Lambda.ReservedConcurrency, 10))
+		if err != nil {
+			return err
+		}
+	} else if fn.Tags[ReservedConcurrencyTagKey] != nil {
+		fmt.Printf("Removing the reserved concurrency goflake set on %s\n", cfg.Resources.lambdaFuncName)
+		_, err := l.DeleteFunctionConcurrency(&lambda.DeleteFunctionConcurrencyInput{
+			FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+		})
+		if err != nil && !isAWSErrorCode(err, lambda.ErrCodeResourceNotFoundException) {
+			return err
+		}
+		err = cfg.untagLambda(l, ReservedConcurrencyTagKey)
+		if err != nil {
+			return err
+		}
+	}
+	if spec.Lambda.ProvisionedConcurrency == 0 {
+		if fn.Tags[ProvisionedConcurrencyTagKey] == nil {
+			return nil
+		}
+		// The alias stays, but costs nothing without provisioned concurrency
+		fmt.Printf("Removing the provisioned concurrency goflake set on %s:%s\n", cfg.Resources.lambdaFuncName, LambdaAlias)
+		_, err := l.DeleteProvisionedConcurrencyConfig(&lambda.DeleteProvisionedConcurrencyConfigInput{
+			FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+			Qualifier:    aws.String(LambdaAlias),
+		})
+		if err != nil && !isAWSErrorCode(err, lambda.ErrCodeResourceNotFoundException) &&
+			!isAWSErrorCode(err, lambda.ErrCodeProvisionedConcurrencyConfigNotFoundException) {
+			return err
+		}
+		return cfg.untagLambda(l, ProvisionedConcurrencyTagKey)
+	}
+
+	// A new function is still Pending until its code is ready
+	err = l.WaitUntilFunctionActive(&lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+	})
+	if err != nil {
+		return err
+	}
+	version, err := l.PublishVersion(&lambda.PublishVersionInput{
+		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = l.CreateAlias(&lambda.CreateAliasInput{
+		FunctionName:    aws.String(cfg.Resources.lambdaFuncName),
+		Name:            aws.String(LambdaAlias),
+		FunctionVersion: version.Version,
+	})
+	if isAWSErrorCode(err, lambda.ErrCodeResourceConflictException) {
+		_, err = l.UpdateAlias(&lambda.UpdateAliasInput{
+			FunctionName:    aws.String(cfg.Resources.lambdaFuncName),
+			Name:            aws.String(LambdaAlias),
+			FunctionVersion: version.Version,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	cfg.Resources.lambdaAlias = LambdaAlias
+
+	fmt.Printf("Provisioning %d concurrent executions of %s:%s\n",
+		spec.Lambda.ProvisionedConcurrency, cfg.Resources.lambdaFuncName, LambdaAlias)
+	_, err = l.PutProvisionedConcurrencyConfig(&lambda.PutProvisionedConcurrencyConfigInput{
+		FunctionName:                    aws.String(cfg.Resources.lambdaFuncName),
+		Qualifier:                       aws.String(LambdaAlias),
+		ProvisionedConcurrentExecutions: aws.Int64(spec.Lambda.ProvisionedConcurrency),
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.tagLambda(l, ProvisionedConcurrencyTagKey, strconv.FormatInt(spec.Lambda.ProvisionedConcurrency, 10))
+}
+
+func (cfg *AWSConfig) tagLambda(l *lambda.Lambda, key string, value string) error {
+	_, err := l.TagResource(&lambda.TagResourceInput{
+		Resource: aws.String(cfg.Resources.lambdaFuncARN),
+		Tags:     map[string]*string{key: aws.String(value)},
+	})
+	return err
+}
+
+func (cfg *AWSConfig) untagLambda(l *lambda.Lambda, key string) error {
+	_, err := l.UntagResource(&lambda.UntagResourceInput{
+		Resource: aws.String(cfg.Resources.lambdaFuncARN),
+		TagKeys:  aws.StringSlice([]string{key}),
+	})
+	return err
+}
+
+// lambdaInvokeARN is the lambda, or its alias, the REST API integrates with.
+func (cfg *AWSConfig) lambdaInvokeARN() string {
+	if cfg.Resources.lambdaAlias != "" {
+		return cfg.Resources.lambdaFuncARN + ":" + cfg.Resources.lambdaAlias
+	}
+	return cfg.Resources.lambdaFuncARN
+}
+
+// CreateRestAPI creates the REST API, or reuses the one already named after
+// the gateway so that re-runs (e.g. for another Snowflake account) keep the
+// same endpoint.
 func (cfg *AWSConfig) CreateRestAPI(g *apigateway.APIGateway) error {
-	gw, err := g.CreateRestApi(&apigateway.CreateRestApiInput{
+	existing, err := cfg.findRestAPI(g)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		fmt.Printf("Reusing REST API %s (%s)\n", cfg.Resources.gatewayName, *existing.Id)
+		_, err = g.TagResource(&apigateway.TagResourceInput{
+			ResourceArn: aws.String(cfg.restAPIARN(*existing.Id)),
+			Tags:        cfg.restAPITags(),
+		})
+		if err != nil {
+			return err
+		}
+		return cfg.useRestAPI(g, existing)
+	}
+
+	input := &apigateway.CreateRestApiInput{
 		Name: aws.String(cfg.Resources.gatewayName),
-	})
+		Tags: cfg.restAPITags(),
+	}
+	if cfg.Resources.gatewayPrivate {
+		input.EndpointConfiguration = &apigateway.EndpointConfiguration{
+			Types:          aws.StringSlice([]string{apigateway.EndpointTypePrivate}),
+			VpcEndpointIds: aws.StringSlice(cfg.Resources.gatewayVpcEndpointIDs),
+		}
+	}
+	gw, err := g.CreateRestApi(input)
 
 	if err != nil {
 		return err
 	}
+	return cfg.useRestAPI(g, &apigateway.RestApi{Id: gw.Id, Name: gw.Name})
+}
+
+// findRestAPI returns the REST API named after the gateway, if any.
+func (cfg *AWSConfig) findRestAPI(g *apigateway.APIGateway) (*apigateway.RestApi, error) {
+	var found *apigateway.RestApi
+	err := g.GetRestApisPages(&apigateway.GetRestApisInput{}, func(page *apigateway.GetRestApisOutput, lastPage bool) bool {
+		for _, api := range page.Items {
+			if aws.StringValue(api.Name) == cfg.Resources.gatewayName {
+				found = api
+				return false
+			}
+		}
+		return true
+	})
+	return found, err
+}
 
+func (cfg *AWSConfig) useRestAPI(g *apigateway.APIGateway, gw *apigateway.RestApi) error {
 	cfg.Resources.gatewayID = *gw.Id
-	cfg.Resources.gatewayEndpoint = fmt.Sprintf("https://%s.execute-api.%s.amazonaws.com/%s/",
-		cfg.Resources.gatewayID, cfg.region, cfg.Resources.gatewayStage)
+	cfg.Resources.gatewayEndpoint = fmt.Sprintf("https://%s.execute-api.%s.%s/%s/",
+		cfg.Resources.gatewayID, cfg.region, cfg.dnsSuffix, cfg.Resources.gatewayStage)
+	if overrides.AWSEndpointURL != "" {
+		// LocalStack serves every REST API from its edge endpoint
+		cfg.Resources.gatewayEndpoint = fmt.Sprintf("%s/restapis/%s/%s/_user_request_/",
+			strings.TrimSuffix(overrides.AWSEndpointURL, "/"), cfg.Resources.gatewayID, cfg.Resources.gatewayStage)
+	}
+	if spec.Gateway.Domain != nil {
+		cfg.Resources.gatewayEndpoint = cfg.domainEndpoint()
+	}
 
 	r2, err := g.GetResources(&apigateway.GetResourcesInput{
 		RestApiId: gw.Id,
 	})
+	if err != nil {
+		return err
+	}
 	cfg.Resources.gatewayMethod = "POST"
 
-	var rootResource *apigateway.Resource
-	if len(r2.Items) > 0 {
-		rootResource = r2.Items[0]
-		cfg.Resources.gatewayRootResource = *rootResource.Id
+	for _, r := range r2.Items {
+		if aws.StringValue(r.Path) == "/" {
+			cfg.Resources.gatewayRootResource = *r.Id
+		}
 	}
 	return nil
 }
@@ -366,15 +729,30 @@ func (cfg *AWSConfig) AddLambdaIntegrationToRestAPI(g *apigateway.APIGateway) er
 		RestApiId:         aws.String(cfg.Resources.gatewayID),
 		ResourceId:        aws.String(cfg.Resources.gatewayRootResource),
 		AuthorizationType: aws.String("AWS_IAM"),
+		ApiKeyRequired:    aws.Bool(cfg.Resources.gatewayAPIKeyRequired),
 	})
 
+	if isAWSErrorCode(err, apigateway.ErrCodeConflictException) {
+		// The method survives from a previous run
+		_, err = g.UpdateMethod(&apigateway.UpdateMethodInput{
+			HttpMethod: aws.String(cfg.Resources.gatewayMethod),
+			RestApiId:  aws.String(cfg.Resources.gatewayID),
+			ResourceId: aws.String(cfg.Resources.gatewayRootResource),
+			PatchOperations: []*apigateway.PatchOperation{
+				{
+					Op:    aws.String("replace"),
+					Path:  aws.String("/apiKeyRequired"),
+					Value: aws.String(strconv.FormatBool(cfg.Resources.gatewayAPIKeyRequired)),
+				},
+			},
+		})
+	}
 	if err != nil {
 		return err
 	}
 
-	uriString := fmt.Sprintf("arn:aws:apigateway:%s:lambda:path/2015-03-31/functions/%s/invocations",
-		cfg.region,
-		cfg.Resources.lambdaFuncARN)
+	uriString := cfg.arn("apigateway", cfg.region, "lambda",
+		fmt.Sprintf("path/2015-03-31/functions/%s/invocations", cfg.lambdaInvokeARN()))
 
 	params := &apigateway.PutIntegrationInput{
 		HttpMethod:            aws.String(cfg.Resources.gatewayMethod),
@@ -415,15 +793,25 @@ func (cfg *AWSConfig) AddLambdaIntegrationToRestAPI(g *apigateway.APIGateway) er
 	}
 	_, err = g.PutMethodResponse(methodResponsParams)
 
-	return err
+	if err != nil && !isAWSErrorCode(err, apigateway.ErrCodeConflictException) {
+		return err
+	}
+	return nil
 }
 
-func (cfg *AWSConfig) ConfigureAwsRoles() error {
+// Provision creates the lambda and its role, the REST API fronting it and the
+// role Snowflake will assume to call the API.
+func (cfg *AWSConfig) Provision() error {
 	err := cfg.SetCurrentAccountID()
 	if err != nil {
 		return err
 	}
 
+	err = cfg.EnsureLambdaLogGroup()
+	if err != nil {
+		return err
+	}
+
 	a := iam.New(cfg.awsSession)
 	err = cfg.CreateLambdaRole(a)
 	if err != nil {
@@ -442,71 +830,98 @@ func (cfg *AWSConfig) ConfigureAwsRoles() error {
 	}
 
 	err = cfg.AddLambdaIntegrationToRestAPI(g)
-	return err
-}
-
-func (scfg *AWSConfig) EnsureRole(roleName string, policyDocument string) (arn string) {
-	i := iam.New(scfg.awsSession)
-	roleInput := &iam.CreateRoleInput{
-		RoleName:                 aws.String(roleName),
-		AssumeRolePolicyDocument: aws.String(policyDocument),
+	if err != nil {
+		return err
 	}
-	if common.AskYesNo("Do you wish to include a Permission Boundary?") {
-		permissionBoundary := common.PromptString("What is the ARN of the boundary you'd like to attach to this role?", false, "")
-		roleInput.SetPermissionsBoundary(permissionBoundary)
+
+	if cfg.Resources.gatewayAPIKeyRequired {
+		err = cfg.EnsureAPIKey(g)
+		if err != nil {
+			return err
+		}
 	}
-	r, err := i.CreateRole(roleInput)
 
-	// Role successfully created
-	if err == nil {
-		return *r.Role.Arn
-	} else {
-		fmt.Println(err)
+	if spec.Gateway.Domain != nil {
+		err = cfg.EnsureDomainName(g)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Get existing Role
-	xr, err := i.GetRole(&iam.GetRoleInput{
-		RoleName: aws.String(roleName),
-	})
+	return cfg.BootstrapGatewayRole(a)
+}
 
-	if err != nil {
-		log.Fatalf("Not able to ensure role %s, encountered error: %s", roleName, err)
-		return
-	}
+func (cfg *AWSConfig) Endpoint() string {
+	return cfg.Resources.gatewayEndpoint
+}
 
-	_, err = i.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
-		PolicyDocument: aws.String(policyDocument),
-		RoleName:       aws.String(roleName),
-	})
+func (cfg *AWSConfig) IntegrationSQL(integration string) string {
+	apiProvider := "aws_api_gateway"
+	if cfg.partition == endpoints.AwsUsGovPartitionID {
+		apiProvider = "aws_gov_api_gateway"
+	}
+	if cfg.Resources.gatewayPrivate {
+		apiProvider = strings.Replace(apiProvider, "_api_gateway", "_private_api_gateway", 1)
+	}
+	return fmt.Sprintf(`create api integration if not exists %s
+	api_provider = %s
+	api_aws_role_arn = '%s'
+	api_allowed_prefixes = ('%s')%s
+	enabled = true;`,
+		integration,
+		apiProvider,
+		cfg.Resources.gatewayRoleARN,
+		cfg.Resources.gatewayEndpoint,
+		cfg.apiKeySQL())
+}
 
-	if err == nil {
-		return *xr.Role.Arn
+// apiKeySQL is the api_key clause of the integration, if a key is required.
+func (cfg *AWSConfig) apiKeySQL() string {
+	if !cfg.Resources.gatewayAPIKeyRequired {
+		return ""
 	}
+	return fmt.Sprintf("\n\tapi_key = '%s'", cfg.Resources.gatewayAPIKey)
+}
+
+func (cfg *AWSConfig) IntegrationUpdateSQL(integration string) string {
+	return fmt.Sprintf(`alter api integration %s set
+	api_aws_role_arn = '%s'
+	api_allowed_prefixes = ('%s')%s
+	enabled = true;`,
+		integration,
+		cfg.Resources.gatewayRoleARN,
+		cfg.Resources.gatewayEndpoint,
+		cfg.apiKeySQL())
+}
 
-	log.Fatalf("Not able to ensure role %s", roleName)
-	return
+func (cfg *AWSConfig) TrustProperties() (externalID string, iamUser string) {
+	return "API_AWS_EXTERNAL_ID", "API_AWS_IAM_USER_ARN"
 }
 
-func (scfg *SnowflakeConfig) AddTrustToAWSRole() error {
+// ApplyTrust lets the Snowflake IAM user assume the gateway role, allows that
+// role to invoke the REST API and deploys the API to its stage.
+func (scfg *AWSConfig) ApplyTrust(externalID string, iamUser string) error {
 	g := apigateway.New(scfg.awsSession, &aws.Config{Region: &scfg.region})
 	i := iam.New(scfg.awsSession)
 
-	scfg.EnsureRole(scfg.Resources.gatewayRoleName,
-		fmt.Sprintf(ExternalApiRoleTrustDocument,
-			scfg.iamUserARN,
-			scfg.apiExternalID))
+	scfg.apiExternalID = externalID
+	scfg.iamUserARN = iamUser
+	err := scfg.TrustSnowflake(i, scfg.iamUserARN, scfg.apiExternalID)
+	if err != nil {
+		return err
+	}
 
-	pd := fmt.Sprintf(InvokeExternalApiPolicyDocument,
-		scfg.region,
-		scfg.awsAccount,
-		scfg.Resources.gatewayID)
+	pd, err := GatewayInvokePolicy(scfg.gatewayExecuteARN()).JSON()
+	if err != nil {
+		return err
+	}
 
 	putParams := &iam.PutRolePolicyInput{
 		PolicyDocument: aws.String(pd),
 		PolicyName:     aws.String(scfg.Resources.gatewayPolicyName),
 		RoleName:       aws.String(scfg.Resources.gatewayRoleName),
 	}
-	_, err := i.PutRolePolicy(putParams)
+	_, err = i.PutRolePolicy(putParams)
 
 	fmt.Println("Waiting 15s for policy to propagate...")
 
@@ -516,56 +931,198 @@ func (scfg *SnowflakeConfig) AddTrustToAWSRole() error {
 		return err
 	}
 
-	pd = fmt.Sprintf(ApiResourcePolicy,
-		scfg.awsAccount,
-		scfg.Resources.gatewayRoleName,
-		scfg.region,
-		scfg.awsAccount,
-		scfg.Resources.gatewayID)
+	if scfg.Resources.gatewayPrivate {
+		err = scfg.AllowInvokeThroughVpcEndpoints()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = scfg.MergeAPIResourcePolicy(g)
+	if err != nil {
+		return err
+	}
 
-	_, err = g.UpdateRestApi(&apigateway.UpdateRestApiInput{
+	_, err = g.CreateDeployment(&apigateway.CreateDeploymentInput{
 		RestApiId: aws.String(scfg.Resources.gatewayID),
+		StageName: aws.String(scfg.Resources.gatewayStage),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if scfg.Resources.gatewayAPIKeyRequired {
+		err = scfg.EnsureUsagePlan(g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if spec.Gateway.Domain != nil {
+		err = scfg.EnsureBasePathMapping(g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if spec.Gateway.WAF != nil {
+		err = scfg.AssociateWebACL()
+	} else {
+		err = scfg.RemoveWebACL(g)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = scfg.ConfigureStage(g)
+	if err != nil {
+		return err
+	}
+
+	return scfg.EnsureMonitoring()
+}
+
+// MergeAPIResourcePolicy adds goflake's statements to the REST API's resource
+// policy, keeping any statements others have added.
+func (cfg *AWSConfig) MergeAPIResourcePolicy(g *apigateway.APIGateway) error {
+	var vpces []string
+	if cfg.Resources.gatewayPrivate {
+		vpces = cfg.Resources.gatewayVpcEndpointIDs
+	}
+	owned := APIResourcePolicy(cfg.snowflakeSessionARN(), cfg.gatewayExecuteARN(), vpces, spec.Gateway.AllowedIPRanges)
+	// Direct invocations (see Invoke) call as their own session of the role
+	owned.PutStatement(SnowflakeInvokeStatement(InvokerInvokeSid, cfg.invokerSessionARN(), cfg.gatewayExecuteARN()))
+
+	policy, err := cfg.apiResourcePolicy(g, aws.String(cfg.Resources.gatewayID))
+	if err != nil {
+		return err
+	}
+	policy.dropLegacyExtensions(APIResourcePolicyName)
+	policy.MergeOwned(owned, GoflakeSidPrefix)
+	return cfg.putAPIResourcePolicy(g, aws.String(cfg.Resources.gatewayID), policy)
+}
+
+// apiResourcePolicy returns the REST API's current resource policy, or an
+// empty document when it has none.
+func (cfg *AWSConfig) apiResourcePolicy(g *apigateway.APIGateway, apiID *string) (*PolicyDocument, error) {
+	api, err := g.GetRestApi(&apigateway.GetRestApiInput{RestApiId: apiID})
+	if err != nil {
+		return nil, err
+	}
+	doc := aws.StringValue(api.Policy)
+	if doc == "" {
+		return NewPolicyDocument(), nil
+	}
+	// API Gateway returns the policy with its quotes escaped
+	if unquoted, err := strconv.Unquote(`"` + doc + `"`); err == nil {
+		doc = unquoted
+	}
+	return ParsePolicyDocument(doc)
+}
+
+func (cfg *AWSConfig) putAPIResourcePolicy(g *apigateway.APIGateway, apiID *string, policy *PolicyDocument) error {
+	value := ""
+	if len(policy.Statement) > 0 {
+		pd, err := policy.JSON()
+		if err != nil {
+			return err
+		}
+		value = pd
+	}
+	_, err := g.UpdateRestApi(&apigateway.UpdateRestApiInput{
+		RestApiId: apiID,
 		PatchOperations: []*apigateway.PatchOperation{
 			{
 				Op:    aws.String("replace"),
 				Path:  aws.String("/policy"),
-				Value: aws.String(pd),
+				Value: aws.String(value),
 			},
 		},
 	})
+	return err
+}
 
+// AllowInvokeThroughVpcEndpoints merges a statement allowing the gateway role
+// to invoke the private API into each VPC endpoint's policy, leaving the
+// statements other APIs rely on untouched.
+func (cfg *AWSConfig) AllowInvokeThroughVpcEndpoints() error {
+	e := ec2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	out, err := e.DescribeVpcEndpoints(&ec2.DescribeVpcEndpointsInput{
+		VpcEndpointIds: aws.StringSlice(cfg.Resources.gatewayVpcEndpointIDs),
+	})
 	if err != nil {
 		return err
 	}
 
-	scfg.executeSnowflakeQuery(fmt.Sprintf(`create or replace external function %s
-    returns variant
-    api_integration = %s_api_integration
-    as '%s'
-	;`, scfg.extFuncSignature,
-		scfg.extFuncName,
-		scfg.Resources.gatewayEndpoint), func(scan func(dest ...interface{}) error) error {
-		var s string = ""
-		err = scan(&s)
+	statement := SnowflakeInvokeStatement(SnowflakeInvokeSid+cfg.Resources.gatewayID,
+		cfg.snowflakeSessionARN(),
+		cfg.gatewayExecuteARN())
+
+	for _, vpce := range out.VpcEndpoints {
+		policy := NewPolicyDocument()
+		if doc := aws.StringValue(vpce.PolicyDocument); doc != "" {
+			policy, err = ParsePolicyDocument(doc)
+			if err != nil {
+				return err
+			}
+		}
+		policy.PutStatement(statement)
+
+		data, err := policy.JSON()
 		if err != nil {
 			return err
 		}
-		fmt.Print(s)
-		return nil
-	})
+		fmt.Printf("Allowing %s to invoke the api through %s\n", cfg.Resources.gatewayRoleName, *vpce.VpcEndpointId)
+		_, err = e.ModifyVpcEndpoint(&ec2.ModifyVpcEndpointInput{
+			VpcEndpointId:  vpce.VpcEndpointId,
+			PolicyDocument: aws.String(data),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	_, err = g.CreateDeployment(&apigateway.CreateDeploymentInput{
-		RestApiId: aws.String(scfg.Resources.gatewayID),
-		StageName: aws.String(scfg.Resources.gatewayStage),
+// revokeInvokeThroughVpcEndpoints removes the statement with the given Sid
+// from each VPC endpoint's policy.
+func (cfg *AWSConfig) revokeInvokeThroughVpcEndpoints(sid string) error {
+	e := ec2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	out, err := e.DescribeVpcEndpoints(&ec2.DescribeVpcEndpointsInput{
+		VpcEndpointIds: aws.StringSlice(cfg.Resources.gatewayVpcEndpointIDs),
 	})
-
 	if err != nil {
 		return err
 	}
-
+	for _, vpce := range out.VpcEndpoints {
+		policy, err := ParsePolicyDocument(aws.StringValue(vpce.PolicyDocument))
+		if err != nil {
+			return err
+		}
+		if !policy.RemoveStatement(sid) {
+			continue
+		}
+		data, err := policy.JSON()
+		if err != nil {
+			return err
+		}
+		_, err = e.ModifyVpcEndpoint(&ec2.ModifyVpcEndpointInput{
+			VpcEndpointId:  vpce.VpcEndpointId,
+			PolicyDocument: aws.String(data),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func isAWSErrorCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
 func (cfg *AWSConfig) DeleteGateways() {
 
 }
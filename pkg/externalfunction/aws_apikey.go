@@ -0,0 +1,251 @@
+package externalfunction
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+)
+
+// Snowflake presents an API key in the x-api-key header when its integration
+// has one. The key belongs to a usage plan bound to the stage, which is what
+// enforces the plan's quota and throttling. Keys are named after the gateway
+// so that rotation can find and retire the previous ones.
+
+func (cfg *AWSConfig) apiKeyPrefix() string {
+	return cfg.Resources.gatewayName + "-key"
+}
+
+func (cfg *AWSConfig) usagePlanName() string {
+	return cfg.Resources.gatewayName + "-usage-plan"
+}
+
+// apiKeys returns the gateway's API keys, newest first.
+func (cfg *AWSConfig) apiKeys(g *apigateway.APIGateway) ([]*apigateway.ApiKey, error) {
+	var keys []*apigateway.ApiKey
+	err := g.GetApiKeysPages(&apigateway.GetApiKeysInput{
+		NameQuery:     aws.String(cfg.apiKeyPrefix()),
+		IncludeValues: aws.Bool(true),
+	}, func(page *apigateway.GetApiKeysOutput, lastPage bool) bool {
+		for _, key := range page.Items {
+			if strings.HasPrefix(aws.StringValue(key.Name), cfg.apiKeyPrefix()) {
+				keys = append(keys, key)
+			}
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return aws.TimeValue(keys[i].CreatedDate).After(aws.TimeValue(keys[j].CreatedDate))
+	})
+	return keys, err
+}
+
+// EnsureAPIKey reuses the gateway's newest API key, or creates one.
+func (cfg *AWSConfig) EnsureAPIKey(g *apigateway.APIGateway) error {
+	keys, err := cfg.apiKeys(g)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		cfg.Resources.gatewayAPIKeyID = aws.StringValue(keys[0].Id)
+		cfg.Resources.gatewayAPIKey = aws.StringValue(keys[0].Value)
+		return nil
+	}
+	_, err = cfg.NewAPIKey()
+	return err
+}
+
+// NewAPIKey creates an API key next to the current ones and adds it to the
+// usage plan, if there is one yet, so both keys work until the old ones are
+// retired.
+func (cfg *AWSConfig) NewAPIKey() (string, error) {
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	key, err := g.CreateApiKey(&apigateway.CreateApiKeyInput{
+		Name:    aws.String(fmt.Sprintf("%s-%d", cfg.apiKeyPrefix(), time.Now().Unix())),
+		Enabled: aws.Bool(true),
+		Tags:    cfg.tags(),
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Created API key %s\n", *key.Name)
+	cfg.Resources.gatewayAPIKeyID = aws.StringValue(key.Id)
+	cfg.Resources.gatewayAPIKey = aws.StringValue(key.Value)
+
+	plan, err := cfg.findUsagePlan(g)
+	if err != nil || plan == nil {
+		return cfg.Resources.gatewayAPIKey, err
+	}
+	return cfg.Resources.gatewayAPIKey, cfg.addKeyToUsagePlan(g, aws.StringValue(plan.Id))
+}
+
+// RetireAPIKeys deletes every key of the gateway but the newest.
+func (cfg *AWSConfig) RetireAPIKeys() error {
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	keys, err := cfg.apiKeys(g)
+	if err != nil || len(keys) < 2 {
+		return err
+	}
+	for _, key := range keys[1:] {
+		fmt.Printf("Deleting API key %s\n", *key.Name)
+		_, err = g.DeleteApiKey(&apigateway.DeleteApiKeyInput{ApiKey: key.Id})
+		if err != nil && !isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *AWSConfig) findUsagePlan(g *apigateway.APIGateway) (*apigateway.UsagePlan, error) {
+	var found *apigateway.UsagePlan
+	err := g.GetUsagePlansPages(&apigateway.GetUsagePlansInput{}, func(page *apigateway.GetUsagePlansOutput, lastPage bool) bool {
+		for _, plan := range page.Items {
+			if aws.StringValue(plan.Name) == cfg.usagePlanName() {
+				found = plan
+				return false
+			}
+		}
+		return true
+	})
+	return found, err
+}
+
+func (cfg *AWSConfig) addKeyToUsagePlan(g *apigateway.APIGateway, planID string) error {
+	_, err := g.CreateUsagePlanKey(&apigateway.CreateUsagePlanKeyInput{
+		UsagePlanId: aws.String(planID),
+		KeyId:       aws.String(cfg.Resources.gatewayAPIKeyID),
+		KeyType:     aws.String("API_KEY"),
+	})
+	if err != nil && !isAWSErrorCode(err, apigateway.ErrCodeConflictException) {
+		return err
+	}
+	return nil
+}
+
+// EnsureUsagePlan binds the usage plan to the deployed stage, creating it or
+// bringing its limits in line with the spec, and adds the API key to it.
+func (cfg *AWSConfig) EnsureUsagePlan(g *apigateway.APIGateway) error {
+	limits := spec.Gateway.UsagePlan
+	stage := &apigateway.ApiStage{
+		ApiId: aws.String(cfg.Resources.gatewayID),
+		Stage: aws.String(cfg.Resources.gatewayStage),
+	}
+	plan, err := cfg.findUsagePlan(g)
+	if err != nil {
+		return err
+	}
+
+	if plan == nil {
+		input := &apigateway.CreateUsagePlanInput{
+			Name:      aws.String(cfg.usagePlanName()),
+			ApiStages: []*apigateway.ApiStage{stage},
+			Tags:      cfg.tags(),
+		}
+		if limits.RateLimit != 0 || limits.BurstLimit != 0 {
+			input.Throttle = &apigateway.ThrottleSettings{
+				RateLimit:  aws.Float64(limits.RateLimit),
+				BurstLimit: aws.Int64(limits.BurstLimit),
+			}
+		}
+		if limits.QuotaLimit != 0 {
+			input.Quota = &apigateway.QuotaSettings{
+				Limit:  aws.Int64(limits.QuotaLimit),
+				Period: aws.String(limits.QuotaPeriod),
+			}
+		}
+		plan, err = g.CreateUsagePlan(input)
+		if err != nil {
+			return err
+		}
+		return cfg.addKeyToUsagePlan(g, aws.StringValue(plan.Id))
+	}
+
+	replace := func(path string, value string) *apigateway.PatchOperation {
+		return &apigateway.PatchOperation{Op: aws.String("replace"), Path: aws.String(path), Value: aws.String(value)}
+	}
+	var ops []*apigateway.PatchOperation
+	bound := false
+	for _, s := range plan.ApiStages {
+		if aws.StringValue(s.ApiId) == cfg.Resources.gatewayID && aws.StringValue(s.Stage) == cfg.Resources.gatewayStage {
+			bound = true
+		}
+	}
+	if !bound {
+		ops = append(ops, &apigateway.PatchOperation{
+			Op:    aws.String("add"),
+			Path:  aws.String("/apiStages"),
+			Value: aws.String(cfg.Resources.gatewayID + ":" + cfg.Resources.gatewayStage),
+		})
+	}
+	if limits.RateLimit != 0 || limits.BurstLimit != 0 {
+		ops = append(ops,
+			replace("/throttle/rateLimit", strconv.FormatFloat(limits.RateLimit, 'f', -1, 64)),
+			replace("/throttle/burstLimit", strconv.FormatInt(limits.BurstLimit, 10)))
+	} else if plan.Throttle != nil {
+		ops = append(ops, &apigateway.PatchOperation{Op: aws.String("remove"), Path: aws.String("/throttle")})
+	}
+	if limits.QuotaLimit != 0 {
+		ops = append(ops,
+			replace("/quota/limit", strconv.FormatInt(limits.QuotaLimit, 10)),
+			replace("/quota/period", limits.QuotaPeriod))
+	} else if plan.Quota != nil {
+		ops = append(ops, &apigateway.PatchOperation{Op: aws.String("remove"), Path: aws.String("/quota")})
+	}
+	if len(ops) > 0 {
+		_, err = g.UpdateUsagePlan(&apigateway.UpdateUsagePlanInput{
+			UsagePlanId:     plan.Id,
+			PatchOperations: ops,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return cfg.addKeyToUsagePlan(g, aws.StringValue(plan.Id))
+}
+
+// deleteUsagePlan unbinds and deletes the gateway's usage plan and deletes
+// its API keys.
+func (cfg *AWSConfig) deleteUsagePlan(g *apigateway.APIGateway) error {
+	plan, err := cfg.findUsagePlan(g)
+	if err != nil {
+		return err
+	}
+	if plan != nil {
+		var ops []*apigateway.PatchOperation
+		for _, s := range plan.ApiStages {
+			ops = append(ops, &apigateway.PatchOperation{
+				Op:    aws.String("remove"),
+				Path:  aws.String("/apiStages"),
+				Value: aws.String(aws.StringValue(s.ApiId) + ":" + aws.StringValue(s.Stage)),
+			})
+		}
+		if len(ops) > 0 {
+			_, err = g.UpdateUsagePlan(&apigateway.UpdateUsagePlanInput{UsagePlanId: plan.Id, PatchOperations: ops})
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Deleting usage plan %s\n", *plan.Name)
+		_, err = g.DeleteUsagePlan(&apigateway.DeleteUsagePlanInput{UsagePlanId: plan.Id})
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := cfg.apiKeys(g)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Printf("Deleting API key %s\n", *key.Name)
+		_, err = g.DeleteApiKey(&apigateway.DeleteApiKeyInput{ApiKey: key.Id})
+		if err != nil && !isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+			return err
+		}
+	}
+	return nil
+}
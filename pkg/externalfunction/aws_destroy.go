@@ -0,0 +1,178 @@
+package externalfunction
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// Destroy deletes the usage plan and API keys, the REST APIs named after the
+// gateway or tagged with the function (disassociating their web ACLs), the
+// web ACL goflake created, the lambda with its log group, alarms and
+// dashboard, and both roles, after removing their inline policies and
+// detaching managed ones. Missing resources are skipped. When a REST API is
+// shared with others, only goflake's statements are removed from its policy
+// and the API is kept; the rest is only deleted once the user agrees.
+func (cfg *AWSConfig) Destroy() error {
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	var apis []*apigateway.RestApi
+	err := g.GetRestApisPages(&apigateway.GetRestApisInput{}, func(page *apigateway.GetRestApisOutput, lastPage bool) bool {
+		for _, api := range page.Items {
+			if aws.StringValue(api.Name) == cfg.Resources.gatewayName ||
+				aws.StringValue(api.Tags[FunctionTagKey]) == cfg.extFuncName {
+				apis = append(apis, api)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Others rely on an API whose policy has statements besides goflake's:
+	// only goflake's access is withdrawn and the API itself is kept
+	var owned []*apigateway.RestApi
+	var shared []string
+	for _, api := range apis {
+		policy, err := cfg.apiResourcePolicy(g, api.Id)
+		if err != nil {
+			return err
+		}
+		policy.dropLegacyExtensions(APIResourcePolicyName)
+		if !policy.RemoveOwned(GoflakeSidPrefix) {
+			owned = append(owned, api)
+			continue
+		}
+		shared = append(shared, fmt.Sprintf("%s (%s)", *api.Name, *api.Id))
+		fmt.Printf("Removing goflake's statements from the policy of shared REST API %s (%s)\n", *api.Name, *api.Id)
+		err = cfg.putAPIResourcePolicy(g, api.Id, policy)
+		if err != nil {
+			return err
+		}
+	}
+	if len(shared) > 0 {
+		question := fmt.Sprintf("REST API %s is shared and integrates with lambda %s. Delete the lambda, roles, usage plan and web ACL goflake created anyway?",
+			strings.Join(shared, ", "), cfg.Resources.lambdaFuncName)
+		if !cfg.prompt.AskYesNo(question) {
+			fmt.Printf("Kept REST API %s with the lambda, roles, usage plan and web ACL it uses\n", strings.Join(shared, ", "))
+			return nil
+		}
+	}
+
+	err = cfg.deleteUsagePlan(g)
+	if err != nil {
+		return err
+	}
+	for _, api := range owned {
+		err = cfg.disassociateWebACLs(g, *api.Id)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if spec.Gateway.Domain != nil {
+			err = cfg.deleteBasePathMapping(g, *api.Id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		fmt.Printf("Deleting REST API %s (%s)\n", *api.Name, *api.Id)
+		_, err = g.DeleteRestApi(&apigateway.DeleteRestApiInput{RestApiId: api.Id})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if cfg.Resources.gatewayPrivate {
+		for _, api := range apis {
+			err = cfg.revokeInvokeThroughVpcEndpoints(SnowflakeInvokeSid + *api.Id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
+	err = cfg.deleteWebACL()
+	if err != nil {
+		return err
+	}
+
+	l := lambda.New(cfg.awsSession, cfg.Resources.regionConfig)
+	fmt.Printf("Deleting lambda %s\n", cfg.Resources.lambdaFuncName)
+	_, err = l.DeleteFunction(&lambda.DeleteFunctionInput{
+		FunctionName: aws.String(cfg.Resources.lambdaFuncName),
+	})
+	if err != nil && !isAWSErrorCode(err, lambda.ErrCodeResourceNotFoundException) {
+		return err
+	}
+
+	cw := cloudwatch.New(cfg.awsSession, cfg.Resources.regionConfig)
+	fmt.Printf("Deleting alarms and dashboard %s\n", cfg.dashboardName())
+	err = cfg.deleteAlarms(cw, cfg.alarms())
+	if err != nil {
+		return err
+	}
+	err = cfg.deleteDashboard(cw)
+	if err != nil {
+		return err
+	}
+
+	c := cloudwatchlogs.New(cfg.awsSession, cfg.Resources.regionConfig)
+	fmt.Printf("Deleting log group %s\n", cfg.lambdaLogGroup())
+	_, err = c.DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{
+		LogGroupName: aws.String(cfg.lambdaLogGroup()),
+	})
+	if err != nil && !isAWSErrorCode(err, cloudwatchlogs.ErrCodeResourceNotFoundException) {
+		return err
+	}
+
+	i := iam.New(cfg.awsSession)
+	for _, r := range []string{cfg.Resources.lambdaRoleName, cfg.Resources.gatewayRoleName} {
+		fmt.Printf("Deleting role %s\n", r)
+		err = i.ListRolePoliciesPages(&iam.ListRolePoliciesInput{
+			RoleName: aws.String(r),
+		}, func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			for _, name := range page.PolicyNames {
+				_, err := i.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+					RoleName:   aws.String(r),
+					PolicyName: name,
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+			return true
+		})
+		if err != nil && !isAWSErrorCode(err, iam.ErrCodeNoSuchEntityException) {
+			return err
+		}
+		err = i.ListAttachedRolePoliciesPages(&iam.ListAttachedRolePoliciesInput{
+			RoleName: aws.String(r),
+		}, func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			for _, p := range page.AttachedPolicies {
+				_, err := i.DetachRolePolicy(&iam.DetachRolePolicyInput{
+					PolicyArn: p.PolicyArn,
+					RoleName:  aws.String(r),
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+			return true
+		})
+		if err != nil && !isAWSErrorCode(err, iam.ErrCodeNoSuchEntityException) {
+			return err
+		}
+		_, err = i.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(r)})
+		if err != nil && !isAWSErrorCode(err, iam.ErrCodeNoSuchEntityException) {
+			return err
+		}
+	}
+	if len(shared) > 0 {
+		fmt.Printf("Kept shared REST API %s, whose integration with lambda %s no longer works\n", strings.Join(shared, ", "), cfg.Resources.lambdaFuncName)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package externalfunction
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// A custom domain keeps the endpoint Snowflake calls (and so the
+// integration's allowed prefixes and the function's URL) stable when the REST
+// API behind it is rebuilt: only the base path mapping moves to the new API.
+
+// domainEndpoint is the stage's URL through the custom domain.
+func (cfg *AWSConfig) domainEndpoint() string {
+	d := spec.Gateway.Domain
+	if d.BasePath == "" {
+		return fmt.Sprintf("https://%s/", d.Name)
+	}
+	return fmt.Sprintf("https://%s/%s/", d.Name, d.BasePath)
+}
+
+// EnsureDomainName creates the custom domain unless it exists, and points its
+// DNS record at the domain when a hosted zone is given.
+func (cfg *AWSConfig) EnsureDomainName(g *apigateway.APIGateway) error {
+	d := spec.Gateway.Domain
+	if cfg.Resources.gatewayPrivate {
+		return fmt.Errorf("custom domain %s cannot front a private api gateway", d.Name)
+	}
+	domain, err := g.GetDomainName(&apigateway.GetDomainNameInput{DomainName: aws.String(d.Name)})
+	if isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+		fmt.Printf("Creating custom domain %s\n", d.Name)
+		domain, err = g.CreateDomainName(&apigateway.CreateDomainNameInput{
+			DomainName:             aws.String(d.Name),
+			RegionalCertificateArn: aws.String(d.CertificateARN),
+			EndpointConfiguration: &apigateway.EndpointConfiguration{
+				Types: aws.StringSlice([]string{apigateway.EndpointTypeRegional}),
+			},
+			SecurityPolicy: aws.String(apigateway.SecurityPolicyTls12),
+			Tags:           cfg.tags(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.HostedZoneID == "" {
+		fmt.Printf("Point %s at %s (hosted zone %s) in your DNS\n", d.Name,
+			aws.StringValue(domain.RegionalDomainName), aws.StringValue(domain.RegionalHostedZoneId))
+		return nil
+	}
+	r := route53.New(cfg.awsSession)
+	_, err = r.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(d.HostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{
+				{
+					Action: aws.String(route53.ChangeActionUpsert),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String(d.Name),
+						Type: aws.String(route53.RRTypeA),
+						AliasTarget: &route53.AliasTarget{
+							DNSName:              domain.RegionalDomainName,
+							HostedZoneId:         domain.RegionalHostedZoneId,
+							EvaluateTargetHealth: aws.Bool(false),
+						},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// basePathKey is how API Gateway refers to the empty base path.
+func basePathKey(basePath string) string {
+	if basePath == "" {
+		return "(none)"
+	}
+	return basePath
+}
+
+// EnsureBasePathMapping maps the domain's base path to the deployed stage,
+// moving an existing mapping over from a previous REST API.
+func (cfg *AWSConfig) EnsureBasePathMapping(g *apigateway.APIGateway) error {
+	d := spec.Gateway.Domain
+	mapping, err := g.GetBasePathMapping(&apigateway.GetBasePathMappingInput{
+		DomainName: aws.String(d.Name),
+		BasePath:   aws.String(basePathKey(d.BasePath)),
+	})
+	if isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+		input := &apigateway.CreateBasePathMappingInput{
+			DomainName: aws.String(d.Name),
+			RestApiId:  aws.String(cfg.Resources.gatewayID),
+			Stage:      aws.String(cfg.Resources.gatewayStage),
+		}
+		if d.BasePath != "" {
+			input.BasePath = aws.String(d.BasePath)
+		}
+		_, err = g.CreateBasePathMapping(input)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(mapping.RestApiId) == cfg.Resources.gatewayID && aws.StringValue(mapping.Stage) == cfg.Resources.gatewayStage {
+		return nil
+	}
+
+	fmt.Printf("Moving %s to REST API %s\n", cfg.domainEndpoint(), cfg.Resources.gatewayID)
+	_, err = g.UpdateBasePathMapping(&apigateway.UpdateBasePathMappingInput{
+		DomainName: aws.String(d.Name),
+		BasePath:   aws.String(basePathKey(d.BasePath)),
+		PatchOperations: []*apigateway.PatchOperation{
+			{Op: aws.String("replace"), Path: aws.String("/restapiId"), Value: aws.String(cfg.Resources.gatewayID)},
+			{Op: aws.String("replace"), Path: aws.String("/stage"), Value: aws.String(cfg.Resources.gatewayStage)},
+		},
+	})
+	return err
+}
+
+// deleteBasePathMapping removes the mapping to the given REST API. The
+// domain itself is kept unless the user asks otherwise, as it may be reused
+// by the next deployment.
+func (cfg *AWSConfig) deleteBasePathMapping(g *apigateway.APIGateway, apiID string) error {
+	d := spec.Gateway.Domain
+	mapping, err := g.GetBasePathMapping(&apigateway.GetBasePathMappingInput{
+		DomainName: aws.String(d.Name),
+		BasePath:   aws.String(basePathKey(d.BasePath)),
+	})
+	if isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+		return nil
+	}
+	if err != nil || aws.StringValue(mapping.RestApiId) != apiID {
+		return err
+	}
+	fmt.Printf("Deleting base path mapping %s\n", cfg.domainEndpoint())
+	_, err = g.DeleteBasePathMapping(&apigateway.DeleteBasePathMappingInput{
+		DomainName: aws.String(d.Name),
+		BasePath:   aws.String(basePathKey(d.BasePath)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if !cfg.prompt.AskYesNo(fmt.Sprintf("Would you like to delete the custom domain %s as well?", d.Name)) {
+		return nil
+	}
+	_, err = g.DeleteDomainName(&apigateway.DeleteDomainNameInput{DomainName: aws.String(d.Name)})
+	if isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+		return nil
+	}
+	return err
+}
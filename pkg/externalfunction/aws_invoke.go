@@ -0,0 +1,146 @@
+package externalfunction
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// InvokerSessionName names the gateway role session direct invocations sign
+// as, so that they are not mistaken for Snowflake's calls.
+const InvokerSessionName = "goflake-invoke"
+
+// Invoke posts body to the stage the way Snowflake does, signed with SigV4 as
+// the gateway role. Unless trustCaller is set the caller must already be
+// allowed to assume the role.
+func (cfg *AWSConfig) Invoke(body []byte, batchID string, trustCaller bool) (*InvokeResult, error) {
+	if cfg.Resources.gatewayID == "" {
+		return nil, fmt.Errorf("REST API %s not found", cfg.Resources.gatewayName)
+	}
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	policy, err := cfg.apiResourcePolicy(g, aws.String(cfg.Resources.gatewayID))
+	if err != nil {
+		return nil, err
+	}
+	if !policy.trusts(cfg.invokerSessionARN(), "") {
+		return nil, fmt.Errorf("the resource policy of REST API %s does not admit direct invocations, re-run goflake to update it", cfg.Resources.gatewayName)
+	}
+
+	creds, withdraw, err := cfg.assumeGatewayRole(trustCaller)
+	if err != nil {
+		return nil, err
+	}
+	defer withdraw()
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Resources.gatewayEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("sf-external-function-format", "json")
+	req.Header.Set("sf-external-function-format-version", "1.0")
+	req.Header.Set("sf-external-function-query-batch-id", batchID)
+	if cfg.Resources.gatewayAPIKeyRequired {
+		keys, err := cfg.apiKeys(g)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no API key found for %s", cfg.Resources.gatewayName)
+		}
+		req.Header.Set("x-api-key", aws.StringValue(keys[0].Value))
+	}
+	_, err = v4.NewSigner(creds).Sign(req, bytes.NewReader(body), "execute-api", cfg.region, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &InvokeResult{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       resBody,
+		Duration:   time.Since(start),
+	}, nil
+}
+
+// assumeGatewayRole assumes the gateway role as InvokerSessionName. The role
+// only trusts Snowflake, so unless the caller has been trusted by hand this
+// fails, or with trustCaller a statement trusting the caller (InvokerTrustSid)
+// is added to its trust for the duration; the returned func withdraws it.
+func (cfg *AWSConfig) assumeGatewayRole(trustCaller bool) (*credentials.Credentials, func(), error) {
+	roleName := cfg.Resources.gatewayRoleName
+	roleARN := cfg.arn("iam", "", cfg.awsAccount, "role/"+roleName)
+	creds := stscreds.NewCredentials(cfg.awsSession, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = InvokerSessionName
+	})
+	_, err := creds.Get()
+	if err == nil {
+		return creds, func() {}, nil
+	}
+	if !trustCaller {
+		return nil, nil, fmt.Errorf("unable to assume %s (%v): have the role trust you, or re-run with -trust-invoker to trust you while invoking", roleARN, err)
+	}
+
+	i := iam.New(cfg.awsSession)
+	id, err := sts.New(cfg.awsSession).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, nil, err
+	}
+	caller, err := iamPrincipal(i, aws.StringValue(id.Arn))
+	if err != nil {
+		return nil, nil, err
+	}
+	trust, _, err := cfg.roleTrust(i, roleName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Warning: role %s will trust %s while invoking. Should goflake be interrupted, remove statement %s from its trust, or run repair-trust\n", roleName, caller, InvokerTrustSid)
+	trust.PutStatement(InvokerTrustStatement(caller))
+	err = cfg.updateRoleTrust(i, roleName, trust)
+	if err != nil {
+		return nil, nil, err
+	}
+	withdraw := func() {
+		trust, _, err := cfg.roleTrust(i, roleName)
+		if err == nil && trust.RemoveStatement(InvokerTrustSid) {
+			err = cfg.updateRoleTrust(i, roleName, trust)
+		}
+		if err != nil {
+			fmt.Printf("Unable to remove statement %s from the trust of role %s, remove it by hand: %v\n", InvokerTrustSid, roleName, err)
+		}
+	}
+
+	// The new trust takes a few seconds to propagate
+	for attempt := 1; ; attempt++ {
+		_, err = creds.Get()
+		if err == nil || attempt == 10 {
+			break
+		}
+		time.Sleep(3 * time.Second)
+	}
+	if err != nil {
+		withdraw()
+		return nil, nil, fmt.Errorf("unable to assume %s: %v", roleARN, err)
+	}
+	return creds, withdraw, nil
+}
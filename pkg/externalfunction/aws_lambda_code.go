@@ -0,0 +1,118 @@
+package externalfunction
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Ways of deploying the lambda's code.
+const (
+	DefaultLambdaSource = "The default function"
+	ZipLambdaSource     = "A local zip file"
+	S3LambdaSource      = "A zip file in S3"
+	ImageLambdaSource   = "A container image"
+)
+
+// planLambdaCode asks where the lambda's code comes from, and the runtime and
+// handler unless it is a container image.
+func (cfg *AWSConfig) planLambdaCode() error {
+	_, source := cfg.prompt.AskOptions("How would you like to deploy the lambda?",
+		[]string{DefaultLambdaSource, ZipLambdaSource, S3LambdaSource, ImageLambdaSource})
+
+	switch source {
+	case ImageLambdaSource:
+		cfg.Resources.lambdaPackageType = lambda.PackageTypeImage
+		cfg.Resources.lambdaImageURI = cfg.prompt.PromptString("What is the URI of the image (an ECR repository in this region)?", false, "")
+		return nil
+	case DefaultLambdaSource:
+		functionData, err := base64.StdEncoding.DecodeString(LambdaZip)
+		if err != nil {
+			return err
+		}
+		cfg.Resources.lambdaFunctionZipBytes = functionData
+	case ZipLambdaSource:
+		data, err := promptZipFile(cfg.prompt)
+		if err != nil {
+			return err
+		}
+		cfg.Resources.lambdaFunctionZipBytes = data
+	case S3LambdaSource:
+		cfg.Resources.lambdaS3Bucket = cfg.prompt.PromptString("What bucket is the zip file in (must be in the lambda's region)?", false, spec.Lambda.ArtifactBucket)
+		cfg.Resources.lambdaS3Key = cfg.prompt.PromptString("What is the key of the zip file?", false, "")
+		cfg.Resources.lambdaS3Version = cfg.prompt.PromptString("What version of the zip file should be used (leave empty for the latest)?", false, "")
+	}
+	cfg.Resources.lambdaPackageType = lambda.PackageTypeZip
+
+	cfg.Resources.lambdaRuntime = cfg.prompt.PromptString(
+		"What lambda runtime would you like to use?",
+		false,
+		lambda.RuntimePython38)
+	handler := "lambda_function.lambda_handler"
+	if source != DefaultLambdaSource {
+		handler = cfg.prompt.PromptString("What is the handler for your lambda function (format is {filename}.{handler function})?", false, handler)
+	}
+	cfg.Resources.lambdaHandler = handler
+	return nil
+}
+
+// MaxInlineZipSize is the largest zip lambda accepts inline; larger ones go
+// through the spec's artifact bucket.
+const MaxInlineZipSize = 50 * 1024 * 1024
+
+// lambdaCode is where lambda takes the function's code from, uploading a local
+// zip to the artifact bucket first when one is configured.
+func (cfg *AWSConfig) lambdaCode() (*lambda.FunctionCode, error) {
+	switch {
+	case cfg.Resources.lambdaPackageType == lambda.PackageTypeImage:
+		return &lambda.FunctionCode{ImageUri: aws.String(cfg.Resources.lambdaImageURI)}, nil
+	case cfg.Resources.lambdaS3Bucket == "" && spec.Lambda.ArtifactBucket != "":
+		err := cfg.uploadLambdaZip(spec.Lambda.ArtifactBucket)
+		if err != nil {
+			return nil, err
+		}
+	case cfg.Resources.lambdaS3Bucket == "":
+		if len(cfg.Resources.lambdaFunctionZipBytes) > MaxInlineZipSize {
+			return nil, fmt.Errorf("the zip file is larger than %dMB, set lambda.artifactBucket in the spec to deploy it through S3", MaxInlineZipSize/1024/1024)
+		}
+		return &lambda.FunctionCode{ZipFile: cfg.Resources.lambdaFunctionZipBytes}, nil
+	}
+
+	code := &lambda.FunctionCode{
+		S3Bucket: aws.String(cfg.Resources.lambdaS3Bucket),
+		S3Key:    aws.String(cfg.Resources.lambdaS3Key),
+	}
+	if cfg.Resources.lambdaS3Version != "" {
+		code.S3ObjectVersion = aws.String(cfg.Resources.lambdaS3Version)
+	}
+	return code, nil
+}
+
+// uploadLambdaZip puts the zip in bucket under a key derived from its
+// contents, so re-running with unchanged code uploads nothing new.
+func (cfg *AWSConfig) uploadLambdaZip(bucket string) error {
+	sum := sha256.Sum256(cfg.Resources.lambdaFunctionZipBytes)
+	key := fmt.Sprintf("goflake/%s/%s.zip", cfg.Resources.lambdaFuncName, hex.EncodeToString(sum[:]))
+	fmt.Printf("Uploading the lambda's code to s3://%s/%s\n", bucket, key)
+
+	uploader := s3manager.NewUploaderWithClient(s3.New(cfg.awsSession, cfg.Resources.regionConfig))
+	out, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(cfg.Resources.lambdaFunctionZipBytes),
+	})
+	if err != nil {
+		return err
+	}
+	cfg.Resources.lambdaS3Bucket = bucket
+	cfg.Resources.lambdaS3Key = key
+	cfg.Resources.lambdaS3Version = aws.StringValue(out.VersionID)
+	return nil
+}
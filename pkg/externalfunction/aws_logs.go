@@ -0,0 +1,130 @@
+package externalfunction
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// ensureLogGroup creates the log group unless it exists, bringing the tags,
+// retention (unless 0) and KMS key (unless empty) of an existing one up to
+// date, and returns its ARN.
+func (cfg *AWSConfig) ensureLogGroup(name string, retentionDays int64, kmsKeyARN string) (string, error) {
+	c := cloudwatchlogs.New(cfg.awsSession, cfg.Resources.regionConfig)
+	input := &cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(name),
+		Tags:         cfg.tags(),
+	}
+	if kmsKeyARN != "" {
+		input.KmsKeyId = aws.String(kmsKeyARN)
+	}
+	_, err := c.CreateLogGroup(input)
+	if isAWSErrorCode(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		_, err = c.TagLogGroup(&cloudwatchlogs.TagLogGroupInput{
+			LogGroupName: aws.String(name),
+			Tags:         cfg.tags(),
+		})
+		if err == nil && kmsKeyARN != "" {
+			_, err = c.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+				LogGroupName: aws.String(name),
+				KmsKeyId:     aws.String(kmsKeyARN),
+			})
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if retentionDays != 0 {
+		_, err = c.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+			LogGroupName:    aws.String(name),
+			RetentionInDays: aws.Int64(retentionDays),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return cfg.arn("logs", cfg.region, cfg.awsAccount, "log-group:"+name), nil
+}
+
+// lambdaLogGroup is the log group lambda writes the function's logs to.
+func (cfg *AWSConfig) lambdaLogGroup() string {
+	return "/aws/lambda/" + cfg.Resources.lambdaFuncName
+}
+
+// DefaultLogRetentionDays applies to the lambda's log group unless the spec
+// says otherwise; lambda itself would keep its logs forever.
+const DefaultLogRetentionDays = 30
+
+// EnsureLambdaLogGroup creates the lambda's log group up front, instead of
+// lambda creating it on first invocation without retention, KMS or tags.
+func (cfg *AWSConfig) EnsureLambdaLogGroup() error {
+	retention := spec.Lambda.LogRetentionDays
+	if retention == 0 {
+		retention = DefaultLogRetentionDays
+	}
+	_, err := cfg.ensureLogGroup(cfg.lambdaLogGroup(), retention, spec.Lambda.LogKMSKeyARN)
+	return err
+}
+
+// Logs prints the lambda's log events of the last since, only those
+// mentioning batchID when it is not empty. Snowflake's batch id is logged by
+// the default lambda next to API Gateway's request id, and when access logs
+// are enabled the matching access log lines are printed too.
+func (cfg *AWSConfig) Logs(batchID string, since time.Duration) error {
+	c := cloudwatchlogs.New(cfg.awsSession, cfg.Resources.regionConfig)
+	start := time.Now().Add(-since)
+	pattern := ""
+	if batchID != "" {
+		pattern = strconv.Quote(batchID)
+	}
+
+	var requestIDs []string
+	err := cfg.printLogEvents(c, cfg.lambdaLogGroup(), pattern, start, func(message string) {
+		var line struct {
+			RequestID string `json:"requestId"`
+			BatchID   string `json:"batchId"`
+		}
+		if json.Unmarshal([]byte(message), &line) == nil && line.BatchID == batchID && line.RequestID != "" {
+			requestIDs = append(requestIDs, line.RequestID)
+		}
+	})
+	if err != nil || batchID == "" || spec.Gateway.Stage.AccessLogGroup == "" {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		err = cfg.printLogEvents(c, spec.Gateway.Stage.AccessLogGroup, fmt.Sprintf(`{ $.requestId = "%s" }`, id), start, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *AWSConfig) printLogEvents(c *cloudwatchlogs.CloudWatchLogs, logGroup string, pattern string, start time.Time, seen func(message string)) error {
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(logGroup),
+		StartTime:    aws.Int64(start.UnixNano() / int64(time.Millisecond)),
+	}
+	if pattern != "" {
+		input.FilterPattern = aws.String(pattern)
+	}
+	fmt.Printf("== %s\n", logGroup)
+	return c.FilterLogEventsPages(input, func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+		for _, event := range page.Events {
+			message := strings.TrimRight(aws.StringValue(event.Message), "\n")
+			timestamp := time.Unix(0, aws.Int64Value(event.Timestamp)*int64(time.Millisecond))
+			fmt.Printf("%s %s\n", timestamp.Format(time.RFC3339), message)
+			if seen != nil {
+				seen(message)
+			}
+		}
+		return true
+	})
+}
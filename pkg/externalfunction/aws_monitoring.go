@@ -0,0 +1,210 @@
+package externalfunction
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// DefaultLatencyThreshold (ms) is just under API Gateway's 29 second
+// integration timeout.
+const DefaultLatencyThreshold = 25000
+
+// alarmName is the name of one of the function's alarms, e.g.
+// goflake-my_func-lambda-errors.
+func (cfg *AWSConfig) alarmName(metric string) string {
+	return fmt.Sprintf("goflake-%s-%s", cfg.extFuncName, metric)
+}
+
+func (cfg *AWSConfig) dashboardName() string {
+	return "goflake-" + cfg.extFuncName
+}
+
+// alarms are the function's alarms, generated from its lambda and REST API.
+func (cfg *AWSConfig) alarms() []*cloudwatch.PutMetricAlarmInput {
+	m := spec.Monitoring
+	errorThreshold := m.ErrorThreshold
+	if errorThreshold == 0 {
+		errorThreshold = 1
+	}
+	durationThreshold := m.DurationThreshold
+	if durationThreshold == 0 {
+		timeout := spec.Lambda.Timeout
+		if timeout == 0 {
+			timeout = 3
+		}
+		durationThreshold = float64(timeout) * 1000 * 0.8
+	}
+	latencyThreshold := m.LatencyThreshold
+	if latencyThreshold == 0 {
+		latencyThreshold = DefaultLatencyThreshold
+	}
+
+	lambdaDimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("FunctionName"), Value: aws.String(cfg.Resources.lambdaFuncName)},
+	}
+	gatewayDimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("ApiName"), Value: aws.String(cfg.Resources.gatewayName)},
+		{Name: aws.String("Stage"), Value: aws.String(cfg.Resources.gatewayStage)},
+	}
+	alarm := func(name string, namespace string, metric string, dimensions []*cloudwatch.Dimension, threshold float64) *cloudwatch.PutMetricAlarmInput {
+		return &cloudwatch.PutMetricAlarmInput{
+			AlarmName:          aws.String(cfg.alarmName(name)),
+			AlarmDescription:   aws.String(fmt.Sprintf("%s %s of external function %s", namespace, metric, cfg.extFuncName)),
+			Namespace:          aws.String(namespace),
+			MetricName:         aws.String(metric),
+			Dimensions:         dimensions,
+			Statistic:          aws.String(cloudwatch.StatisticSum),
+			Period:             aws.Int64(300),
+			EvaluationPeriods:  aws.Int64(1),
+			Threshold:          aws.Float64(threshold),
+			ComparisonOperator: aws.String(cloudwatch.ComparisonOperatorGreaterThanOrEqualToThreshold),
+			TreatMissingData:   aws.String("notBreaching"),
+			AlarmActions:       []*string{aws.String(m.AlarmTopicARN)},
+			OKActions:          []*string{aws.String(m.AlarmTopicARN)},
+			Tags:               cfg.cloudwatchTags(),
+		}
+	}
+	p99 := func(input *cloudwatch.PutMetricAlarmInput) *cloudwatch.PutMetricAlarmInput {
+		input.Statistic = nil
+		input.ExtendedStatistic = aws.String("p99")
+		input.ComparisonOperator = aws.String(cloudwatch.ComparisonOperatorGreaterThanThreshold)
+		return input
+	}
+	return []*cloudwatch.PutMetricAlarmInput{
+		alarm("lambda-errors", "AWS/Lambda", "Errors", lambdaDimensions, errorThreshold),
+		alarm("lambda-throttles", "AWS/Lambda", "Throttles", lambdaDimensions, errorThreshold),
+		p99(alarm("lambda-duration-p99", "AWS/Lambda", "Duration", lambdaDimensions, durationThreshold)),
+		alarm("gateway-4xx", "AWS/ApiGateway", "4XXError", gatewayDimensions, errorThreshold),
+		alarm("gateway-5xx", "AWS/ApiGateway", "5XXError", gatewayDimensions, errorThreshold),
+		p99(alarm("gateway-latency-p99", "AWS/ApiGateway", "Latency", gatewayDimensions, latencyThreshold)),
+	}
+}
+
+func (cfg *AWSConfig) cloudwatchTags() []*cloudwatch.Tag {
+	var tags []*cloudwatch.Tag
+	for _, tag := range cfg.iamTags() {
+		tags = append(tags, &cloudwatch.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tags
+}
+
+// alarmARNs identify the function's alarms.
+func (cfg *AWSConfig) alarmARNs() []string {
+	var arns []string
+	for _, alarm := range cfg.alarms() {
+		arns = append(arns, cfg.arn("cloudwatch", cfg.region, cfg.awsAccount, "alarm:"+aws.StringValue(alarm.AlarmName)))
+	}
+	return arns
+}
+
+// EnsureMonitoring creates the function's alarms when an alarm topic is
+// configured and its dashboard when one is asked for, and deletes them once
+// they are no longer in the spec.
+func (cfg *AWSConfig) EnsureMonitoring() error {
+	c := cloudwatch.New(cfg.awsSession, cfg.Resources.regionConfig)
+	alarms := cfg.alarms()
+	var alarmARNs []string
+	if spec.Monitoring.AlarmTopicARN != "" {
+		for _, alarm := range alarms {
+			_, err := c.PutMetricAlarm(alarm)
+			if err != nil {
+				return err
+			}
+		}
+		alarmARNs = cfg.alarmARNs()
+		fmt.Printf("%d alarms notify %s\n", len(alarms), spec.Monitoring.AlarmTopicARN)
+	} else {
+		err := cfg.deleteAlarms(c, alarms)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !spec.Monitoring.Dashboard {
+		return cfg.deleteDashboard(c)
+	}
+	body, err := cfg.dashboardBody(alarmARNs)
+	if err != nil {
+		return err
+	}
+	_, err = c.PutDashboard(&cloudwatch.PutDashboardInput{
+		DashboardName: aws.String(cfg.dashboardName()),
+		DashboardBody: aws.String(body),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Dashboard: https://%s/cloudwatch/home?region=%s#dashboards:name=%s\n", consoleHost(cfg.partition), cfg.region, cfg.dashboardName())
+	return nil
+}
+
+// dashboardBody lays out the lambda's and the REST API's metrics, with the
+// alarms' states on top when there are any.
+func (cfg *AWSConfig) dashboardBody(alarmARNs []string) (string, error) {
+	type widget map[string]interface{}
+	metrics := func(title string, stat string, namespace string, dimensions []string, names ...string) widget {
+		var lines [][]string
+		for _, name := range names {
+			lines = append(lines, append([]string{namespace, name}, dimensions...))
+		}
+		return widget{
+			"type":   "metric",
+			"width":  12,
+			"height": 6,
+			"properties": map[string]interface{}{
+				"title":   title,
+				"region":  cfg.region,
+				"view":    "timeSeries",
+				"stat":    stat,
+				"period":  300,
+				"metrics": lines,
+			},
+		}
+	}
+	lambdaDimensions := []string{"FunctionName", cfg.Resources.lambdaFuncName}
+	gatewayDimensions := []string{"ApiName", cfg.Resources.gatewayName, "Stage", cfg.Resources.gatewayStage}
+
+	var widgets []widget
+	if len(alarmARNs) > 0 {
+		widgets = append(widgets, widget{
+			"type":   "alarm",
+			"width":  24,
+			"height": 3,
+			"properties": map[string]interface{}{
+				"title":  "Alarms",
+				"alarms": alarmARNs,
+			},
+		})
+	}
+	widgets = append(widgets,
+		metrics("Lambda invocations", "Sum", "AWS/Lambda", lambdaDimensions, "Invocations", "Errors", "Throttles"),
+		metrics("Lambda duration p99", "p99", "AWS/Lambda", lambdaDimensions, "Duration"),
+		metrics("REST API requests", "Sum", "AWS/ApiGateway", gatewayDimensions, "Count", "4XXError", "5XXError"),
+		metrics("REST API latency p99", "p99", "AWS/ApiGateway", gatewayDimensions, "Latency", "IntegrationLatency"),
+	)
+	body, err := json.Marshal(map[string]interface{}{"widgets": widgets})
+	return string(body), err
+}
+
+func (cfg *AWSConfig) deleteAlarms(c *cloudwatch.CloudWatch, alarms []*cloudwatch.PutMetricAlarmInput) error {
+	var names []*string
+	for _, alarm := range alarms {
+		names = append(names, alarm.AlarmName)
+	}
+	// Deleting alarms that don't exist is not an error
+	_, err := c.DeleteAlarms(&cloudwatch.DeleteAlarmsInput{AlarmNames: names})
+	return err
+}
+
+func (cfg *AWSConfig) deleteDashboard(c *cloudwatch.CloudWatch) error {
+	_, err := c.DeleteDashboards(&cloudwatch.DeleteDashboardsInput{
+		DashboardNames: []*string{aws.String(cfg.dashboardName())},
+	})
+	if isAWSErrorCode(err, cloudwatch.ErrCodeDashboardNotFoundError) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package externalfunction
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// preflightCall is a set of IAM actions goflake calls on the same resources.
+type preflightCall struct {
+	actions   []string
+	resources []string
+}
+
+// preflightCalls are the IAM actions deploying, invoking and destroying the
+// planned function call, grouped by the resources they are called on. The
+// existing REST API, if any, is looked up for its id and for a web ACL that
+// re-running would disassociate.
+func (cfg *AWSConfig) preflightCalls() []preflightCall {
+	all := []string{"*"}
+	lambdaRoleARN := cfg.arn("iam", "", cfg.awsAccount, "role/"+cfg.Resources.lambdaRoleName)
+	gatewayRoleARN := cfg.arn("iam", "", cfg.awsAccount, "role/"+cfg.Resources.gatewayRoleName)
+	lambdaARN := cfg.arn("lambda", cfg.region, cfg.awsAccount, "function:"+cfg.Resources.lambdaFuncName)
+
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	apiID, webACLTagged := "*", false
+	if api, err := cfg.findRestAPI(g); err == nil && api != nil {
+		apiID = aws.StringValue(api.Id)
+		stage, err := g.GetStage(&apigateway.GetStageInput{
+			RestApiId: api.Id,
+			StageName: aws.String(cfg.Resources.gatewayStage),
+		})
+		webACLTagged = err == nil && aws.StringValue(stage.Tags[WebACLTagKey]) != ""
+	}
+	apiResources := []string{
+		cfg.arn("apigateway", cfg.region, "", "/restapis"),
+		cfg.restAPIARN(apiID),
+		cfg.restAPIARN(apiID) + "/*",
+		cfg.arn("apigateway", cfg.region, "", "/tags/*"),
+	}
+
+	calls := []preflightCall{
+		// Resolve, Inventory and the caller's identity
+		{[]string{"sts:GetCallerIdentity", "tag:GetResources", "iam:ListRoles"}, all},
+		// CreateLambdaRole, BootstrapGatewayRole, the trust phases and Destroy
+		{[]string{"iam:GetRole", "iam:CreateRole", "iam:UpdateAssumeRolePolicy", "iam:PutRolePolicy",
+			"iam:AttachRolePolicy", "iam:TagRole", "iam:ListRoleTags", "iam:ListRolePolicies", "iam:DeleteRolePolicy",
+			"iam:ListAttachedRolePolicies", "iam:DetachRolePolicy", "iam:DeleteRole"},
+			[]string{lambdaRoleARN, gatewayRoleARN}},
+		{[]string{"iam:PassRole"}, []string{lambdaRoleARN}},
+		// CreateOrConfigureLambdaFunc, configureLambdaConcurrency and Destroy
+		{[]string{"lambda:CreateFunction", "lambda:UpdateFunctionCode", "lambda:UpdateFunctionConfiguration",
+			"lambda:GetFunction", "lambda:GetFunctionConfiguration", "lambda:AddPermission", "lambda:TagResource",
+			"lambda:UntagResource", "lambda:PutFunctionConcurrency", "lambda:DeleteFunctionConcurrency",
+			"lambda:PublishVersion", "lambda:CreateAlias", "lambda:UpdateAlias", "lambda:DeleteFunction"},
+			[]string{lambdaARN}},
+		{[]string{"lambda:PutProvisionedConcurrencyConfig", "lambda:DeleteProvisionedConcurrencyConfig"},
+			[]string{lambdaARN + ":" + LambdaAlias}},
+		// EnsureLambdaLogGroup, Logs and Destroy
+		{[]string{"logs:CreateLogGroup", "logs:PutRetentionPolicy", "logs:TagLogGroup", "logs:DeleteLogGroup",
+			"logs:FilterLogEvents"},
+			[]string{cfg.lambdaLogGroupARN() + ":*"}},
+		// The REST API, its stage, deployments, resource policy and tags
+		{[]string{"apigateway:GET", "apigateway:POST", "apigateway:PUT", "apigateway:PATCH", "apigateway:DELETE"},
+			apiResources},
+		// EnsureMonitoring and Destroy
+		{[]string{"cloudwatch:PutMetricAlarm", "cloudwatch:DeleteAlarms"}, cfg.alarmARNs()},
+		{[]string{"cloudwatch:PutDashboard", "cloudwatch:DeleteDashboards"},
+			[]string{cfg.arn("cloudwatch", "", cfg.awsAccount, "dashboard/"+cfg.dashboardName())}},
+		// Destroy looks for goflake's web ACL whether or not the spec has one
+		{[]string{"wafv2:ListWebACLs", "wafv2:ListIPSets"}, all},
+		{[]string{"wafv2:GetWebACLForResource"}, []string{cfg.stageARN(apiID, "*")}},
+	}
+
+	if spec.Lambda.LogKMSKeyARN != "" {
+		calls = append(calls, preflightCall{[]string{"logs:AssociateKmsKey"}, []string{cfg.lambdaLogGroupARN() + ":*"}})
+	}
+	if cfg.Resources.lambdaS3Bucket != "" {
+		calls = append(calls, preflightCall{[]string{"s3:GetObject"},
+			[]string{cfg.arn("s3", "", "", cfg.Resources.lambdaS3Bucket+"/"+cfg.Resources.lambdaS3Key)}})
+	} else if spec.Lambda.ArtifactBucket != "" {
+		calls = append(calls, preflightCall{[]string{"s3:PutObject", "s3:GetObject"},
+			[]string{cfg.arn("s3", "", "", spec.Lambda.ArtifactBucket+"/goflake/"+cfg.Resources.lambdaFuncName+"/*")}})
+	}
+	if cfg.Resources.gatewayAPIKeyRequired {
+		calls = append(calls, preflightCall{
+			[]string{"apigateway:GET", "apigateway:POST", "apigateway:PATCH", "apigateway:DELETE"},
+			[]string{
+				cfg.arn("apigateway", cfg.region, "", "/apikeys"),
+				cfg.arn("apigateway", cfg.region, "", "/apikeys/*"),
+				cfg.arn("apigateway", cfg.region, "", "/usageplans"),
+				cfg.arn("apigateway", cfg.region, "", "/usageplans/*"),
+			}})
+	}
+	if d := spec.Gateway.Domain; d != nil {
+		calls = append(calls, preflightCall{
+			[]string{"apigateway:GET", "apigateway:POST", "apigateway:PATCH", "apigateway:DELETE"},
+			[]string{
+				cfg.arn("apigateway", cfg.region, "", "/domainnames"),
+				cfg.arn("apigateway", cfg.region, "", "/domainnames/"+d.Name),
+				cfg.arn("apigateway", cfg.region, "", "/domainnames/"+d.Name+"/*"),
+			}})
+		if d.HostedZoneID != "" {
+			calls = append(calls, preflightCall{[]string{"route53:ChangeResourceRecordSets"},
+				[]string{cfg.arn("route53", "", "", "hostedzone/"+d.HostedZoneID)}})
+		}
+	}
+	if cfg.Resources.gatewayPrivate {
+		calls = append(calls, preflightCall{[]string{"ec2:DescribeVpcEndpoints"}, all})
+		var endpoints []string
+		for _, id := range cfg.Resources.gatewayVpcEndpointIDs {
+			endpoints = append(endpoints, cfg.arn("ec2", cfg.region, cfg.awsAccount, "vpc-endpoint/"+id))
+		}
+		calls = append(calls, preflightCall{[]string{"ec2:ModifyVpcEndpoint"}, endpoints})
+	}
+	stage := spec.Gateway.Stage
+	if (stage.LoggingLevel != "" && stage.LoggingLevel != "OFF") || stage.DataTrace || stage.AccessLogGroup != "" {
+		// ensureGatewayLoggingRole
+		loggingRoleARN := cfg.arn("iam", "", cfg.awsAccount, "role/"+GatewayLoggingRoleName)
+		calls = append(calls,
+			preflightCall{[]string{"apigateway:GET", "apigateway:PATCH"}, []string{cfg.arn("apigateway", cfg.region, "", "/account")}},
+			preflightCall{[]string{"iam:GetRole", "iam:CreateRole", "iam:AttachRolePolicy", "iam:PassRole"}, []string{loggingRoleARN}})
+	}
+	if stage.AccessLogGroup != "" {
+		calls = append(calls, preflightCall{[]string{"logs:CreateLogGroup", "logs:TagLogGroup"},
+			[]string{cfg.arn("logs", cfg.region, cfg.awsAccount, "log-group:"+stage.AccessLogGroup+":*")}})
+	}
+
+	webACL := cfg.arn("wafv2", cfg.region, cfg.awsAccount, "regional/webacl/"+cfg.webACLName()+"/*")
+	ipSet := cfg.arn("wafv2", cfg.region, cfg.awsAccount, "regional/ipset/"+cfg.ipSetName()+"/*")
+	stageARN := cfg.stageARN(apiID, cfg.Resources.gatewayStage)
+	switch {
+	case spec.Gateway.WAF != nil:
+		// AssociateWebACL
+		if spec.Gateway.WAF.WebACLARN != "" {
+			webACL = spec.Gateway.WAF.WebACLARN
+		} else {
+			calls = append(calls,
+				preflightCall{[]string{"wafv2:CreateWebACL"}, []string{webACL, ipSet}},
+				preflightCall{[]string{"wafv2:CreateIPSet", "wafv2:GetIPSet", "wafv2:UpdateIPSet"}, []string{ipSet}})
+		}
+		calls = append(calls,
+			preflightCall{[]string{"wafv2:GetWebACLForResource", "wafv2:AssociateWebACL"}, []string{webACL, stageARN}},
+			preflightCall{[]string{"apigateway:PUT"}, []string{cfg.arn("apigateway", cfg.region, "", "/tags/*")}})
+	case webACLTagged:
+		// RemoveWebACL, once gateway.waf is dropped from the spec
+		calls = append(calls,
+			preflightCall{[]string{"wafv2:GetWebACLForResource", "wafv2:DisassociateWebACL"}, []string{stageARN}},
+			preflightCall{[]string{"wafv2:ListResourcesForWebACL", "wafv2:DeleteWebACL"}, []string{webACL}},
+			preflightCall{[]string{"wafv2:DeleteIPSet"}, []string{ipSet}})
+	}
+	return calls
+}
+
+// iamPrincipal is the IAM identity behind the caller ARN: the role itself for
+// an assumed role's session. The role's ARN has its path (e.g. SSO's
+// /aws-reserved/...) while the session's does not.
+func iamPrincipal(i *iam.IAM, callerARN string) (string, error) {
+	parts := strings.Split(callerARN, ":assumed-role/")
+	if len(parts) != 2 {
+		return callerARN, nil
+	}
+	role, err := i.GetRole(&iam.GetRoleInput{RoleName: aws.String(strings.Split(parts[1], "/")[0])})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(role.Role.Arn), nil
+}
+
+// Preflight simulates the caller's IAM policies for every action goflake
+// will call on the planned resources, one check per service.
+func (cfg *AWSConfig) Preflight() []Check {
+	s := sts.New(cfg.awsSession)
+	id, err := s.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return []Check{{Name: "AWS credentials", Err: err}}
+	}
+	checks := []Check{{Name: "AWS credentials", Detail: aws.StringValue(id.Arn)}}
+	cfg.awsAccount = aws.StringValue(id.Account)
+
+	principal := aws.StringValue(id.Arn)
+	if strings.HasSuffix(principal, ":root") {
+		return append(checks, Check{Name: "AWS permissions", Detail: "the root user is allowed everything"})
+	}
+	i := iam.New(cfg.awsSession)
+	principal, err = iamPrincipal(i, principal)
+	if err != nil {
+		return append(checks, Check{Name: "AWS permissions", Err: err})
+	}
+
+	var services []string
+	counts := map[string]int{}
+	denied := map[string][]string{}
+	for _, call := range cfg.preflightCalls() {
+		for _, action := range call.actions {
+			service := strings.Split(action, ":")[0]
+			if counts[service] == 0 {
+				services = append(services, service)
+			}
+			counts[service]++
+		}
+		input := &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     aws.StringSlice(call.actions),
+		}
+		if !reflect.DeepEqual(call.resources, []string{"*"}) {
+			input.ResourceArns = aws.StringSlice(call.resources)
+		}
+		err = i.SimulatePrincipalPolicyPages(input, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, r := range page.EvaluationResults {
+				if aws.StringValue(r.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+					action := aws.StringValue(r.EvalActionName)
+					if resource := aws.StringValue(r.EvalResourceName); resource != "*" && resource != "" {
+						action += " on " + resource
+					}
+					service := strings.Split(action, ":")[0]
+					denied[service] = append(denied[service], action)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return append(checks, Check{Name: "AWS permissions", Err: err})
+		}
+	}
+
+	for _, service := range services {
+		check := Check{Name: "AWS " + service + " permissions", Detail: fmt.Sprintf("%d actions allowed", counts[service])}
+		if len(denied[service]) > 0 {
+			check.Err = fmt.Errorf("denied: %s", strings.Join(denied[service], ", "))
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
@@ -0,0 +1,186 @@
+package externalfunction
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// Resolve looks up the resources of a function goflake created by the
+// function tag it put on them, asking only for credentials rather than every
+// name Plan does. The stage is the one the REST API's stage tag records, the
+// spec's, or else the API's only stage. Other names that are not found keep
+// the defaults Plan suggests.
+func (cfg *AWSConfig) Resolve(extFuncName string, extFuncSignature string) error {
+	cfg.extFuncName = extFuncName
+	cfg.extFuncSignature = extFuncSignature
+
+	err := cfg.Connect()
+	if err != nil {
+		return err
+	}
+	err = cfg.SetCurrentAccountID()
+	if err != nil {
+		return err
+	}
+	cfg.Resources.lambdaFuncName = extFuncName + "-lambda"
+	cfg.Resources.gatewayName = extFuncName + "-gateway"
+	cfg.Resources.gatewayRoleName = extFuncName + "-gateway-role"
+	cfg.Resources.gatewayStage = spec.Gateway.Stage.Name
+
+	var apiID string
+	t := resourcegroupstaggingapi.New(cfg.awsSession, cfg.Resources.regionConfig)
+	err = t.GetResourcesPages(&resourcegroupstaggingapi.GetResourcesInput{
+		TagFilters: []*resourcegroupstaggingapi.TagFilter{
+			{Key: aws.String(FunctionTagKey), Values: aws.StringSlice([]string{extFuncName})},
+		},
+	}, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		for _, r := range page.ResourceTagMappingList {
+			a, err := arn.Parse(aws.StringValue(r.ResourceARN))
+			if err != nil {
+				continue
+			}
+			switch {
+			case a.Service == "lambda" && strings.HasPrefix(a.Resource, "function:"):
+				cfg.Resources.lambdaFuncName = strings.Split(a.Resource, ":")[1]
+			case a.Service == "apigateway" && strings.HasPrefix(a.Resource, "/restapis/"):
+				apiID = strings.Split(a.Resource, "/")[2]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	var api *apigateway.RestApi
+	if apiID != "" {
+		api, err = g.GetRestApi(&apigateway.GetRestApiInput{RestApiId: aws.String(apiID)})
+	} else {
+		api, err = cfg.findRestAPI(g)
+	}
+	if err != nil {
+		return err
+	}
+	if api == nil {
+		fmt.Printf("No REST API was found for %s, using lambda %s\n", extFuncName, cfg.Resources.lambdaFuncName)
+		return nil
+	}
+	cfg.Resources.gatewayName = aws.StringValue(api.Name)
+
+	// The resource policy names the role Snowflake calls the API as
+	policy, err := cfg.apiResourcePolicy(g, api.Id)
+	if err != nil {
+		return err
+	}
+	for _, s := range policy.Statement {
+		if s.Sid != SnowflakeInvokeSid || s.Principal == nil {
+			continue
+		}
+		for _, principal := range s.Principal.AWS {
+			if parts := strings.Split(principal, ":assumed-role/"); len(parts) == 2 {
+				cfg.Resources.gatewayRoleName = strings.Split(parts[1], "/")[0]
+			}
+		}
+	}
+
+	if stage := aws.StringValue(api.Tags[StageTagKey]); stage != "" {
+		cfg.Resources.gatewayStage = stage
+	}
+	if cfg.Resources.gatewayStage == "" {
+		stages, err := g.GetStages(&apigateway.GetStagesInput{RestApiId: api.Id})
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, stage := range stages.Item {
+			names = append(names, aws.StringValue(stage.StageName))
+		}
+		switch {
+		case len(names) == 0:
+			return fmt.Errorf("REST API %s has no stage, re-run goflake to deploy it", cfg.Resources.gatewayName)
+		case len(names) == 1:
+			cfg.Resources.gatewayStage = names[0]
+		default:
+			sort.Strings(names)
+			_, cfg.Resources.gatewayStage = cfg.prompt.AskOptions("Which stage of the api gateway should be used?", names)
+		}
+	}
+
+	err = cfg.useRestAPI(g, api)
+	if err != nil {
+		return err
+	}
+	method, err := g.GetMethod(&apigateway.GetMethodInput{
+		RestApiId:  api.Id,
+		ResourceId: aws.String(cfg.Resources.gatewayRootResource),
+		HttpMethod: aws.String(cfg.Resources.gatewayMethod),
+	})
+	if err != nil && !isAWSErrorCode(err, apigateway.ErrCodeNotFoundException) {
+		return err
+	}
+	if method != nil {
+		cfg.Resources.gatewayAPIKeyRequired = aws.BoolValue(method.ApiKeyRequired)
+	}
+
+	fmt.Printf("Using lambda %s, REST API %s (%s) stage %s and role %s\n", cfg.Resources.lambdaFuncName,
+		cfg.Resources.gatewayName, cfg.Resources.gatewayID, cfg.Resources.gatewayStage, cfg.Resources.gatewayRoleName)
+	return nil
+}
+
+// Inventory finds the lambdas, REST APIs and roles tagged with goflake's
+// function tag.
+func (cfg *AWSConfig) Inventory() (map[string][]string, error) {
+	found := map[string][]string{}
+	t := resourcegroupstaggingapi.New(cfg.awsSession, cfg.Resources.regionConfig)
+	err := t.GetResourcesPages(&resourcegroupstaggingapi.GetResourcesInput{
+		TagFilters: []*resourcegroupstaggingapi.TagFilter{
+			{Key: aws.String(FunctionTagKey)},
+		},
+	}, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		for _, r := range page.ResourceTagMappingList {
+			for _, tag := range r.Tags {
+				if aws.StringValue(tag.Key) == FunctionTagKey {
+					fn := aws.StringValue(tag.Value)
+					found[fn] = append(found[fn], aws.StringValue(r.ResourceARN))
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// IAM is global and not covered by the tagging API, and ListRoles does
+	// not return tags
+	i := iam.New(cfg.awsSession)
+	var tagErr error
+	err = i.ListRolesPages(&iam.ListRolesInput{}, func(page *iam.ListRolesOutput, lastPage bool) bool {
+		for _, role := range page.Roles {
+			tags, err := i.ListRoleTags(&iam.ListRoleTagsInput{RoleName: role.RoleName})
+			if err != nil {
+				tagErr = err
+				return false
+			}
+			for _, tag := range tags.Tags {
+				if aws.StringValue(tag.Key) == FunctionTagKey {
+					fn := aws.StringValue(tag.Value)
+					found[fn] = append(found[fn], aws.StringValue(role.Arn))
+				}
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = tagErr
+	}
+	return found, err
+}
@@ -0,0 +1,181 @@
+package externalfunction
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// AccessLogFormat is the JSON access log line of the stage. API Gateway does
+// not expose request headers to access logs, so Snowflake's
+// sf-external-function-query-batch-id header cannot be logged here directly:
+// the default lambda logs it next to requestId, which joins the two.
+const AccessLogFormat = `{"requestId":"$context.requestId","extendedRequestId":"$context.extendedRequestId",` +
+	`"requestTime":"$context.requestTime","ip":"$context.identity.sourceIp","caller":"$context.identity.caller",` +
+	`"user":"$context.identity.user","userArn":"$context.identity.userArn","httpMethod":"$context.httpMethod",` +
+	`"resourcePath":"$context.resourcePath","status":"$context.status","protocol":"$context.protocol",` +
+	`"responseLength":"$context.responseLength","responseLatency":"$context.responseLatency",` +
+	`"integrationStatus":"$context.integration.status","integrationLatency":"$context.integration.latency",` +
+	`"errorMessage":"$context.error.message","xrayTraceId":"$context.xrayTraceId"}`
+
+// ConfigureStage applies the spec's stage settings to the deployed stage.
+// Settings removed from the spec are reset, so re-running goflake reconciles
+// the stage with the spec rather than only adding to it.
+func (cfg *AWSConfig) ConfigureStage(g *apigateway.APIGateway) error {
+	stage, err := g.GetStage(&apigateway.GetStageInput{
+		RestApiId: aws.String(cfg.Resources.gatewayID),
+		StageName: aws.String(cfg.Resources.gatewayStage),
+	})
+	if err != nil {
+		return err
+	}
+	settings := spec.Gateway.Stage
+	replace := func(path string, value string) *apigateway.PatchOperation {
+		return &apigateway.PatchOperation{Op: aws.String("replace"), Path: aws.String(path), Value: aws.String(value)}
+	}
+	remove := func(path string) *apigateway.PatchOperation {
+		return &apigateway.PatchOperation{Op: aws.String("remove"), Path: aws.String(path)}
+	}
+
+	ops := []*apigateway.PatchOperation{
+		replace("/tracingEnabled", strconv.FormatBool(settings.TracingEnabled)),
+	}
+
+	// Method settings of every resource and method
+	loggingLevel := settings.LoggingLevel
+	if loggingLevel == "" {
+		loggingLevel = "OFF"
+	}
+	// Access logs need the account's CloudWatch role as much as execution logs
+	if loggingLevel != "OFF" || settings.DataTrace || settings.AccessLogGroup != "" {
+		err = cfg.ensureGatewayLoggingRole(g)
+		if err != nil {
+			return err
+		}
+	}
+	_, configured := stage.MethodSettings["*/*"]
+	if configured || loggingLevel != "OFF" || settings.DataTrace || settings.ThrottlingRateLimit != 0 || settings.ThrottlingBurstLimit != 0 {
+		ops = append(ops,
+			replace("/*/*/logging/loglevel", loggingLevel),
+			replace("/*/*/logging/dataTrace", strconv.FormatBool(settings.DataTrace)))
+		// Unset limits are removed so the account's current limits apply
+		if settings.ThrottlingRateLimit != 0 {
+			ops = append(ops, replace("/*/*/throttling/rateLimit", strconv.FormatFloat(settings.ThrottlingRateLimit, 'f', -1, 64)))
+		} else if configured {
+			ops = append(ops, remove("/*/*/throttling/rateLimit"))
+		}
+		if settings.ThrottlingBurstLimit != 0 {
+			ops = append(ops, replace("/*/*/throttling/burstLimit", strconv.FormatInt(settings.ThrottlingBurstLimit, 10)))
+		} else if configured {
+			ops = append(ops, remove("/*/*/throttling/burstLimit"))
+		}
+	}
+
+	// Access logs
+	if settings.AccessLogGroup != "" {
+		logGroupARN, err := cfg.ensureLogGroup(settings.AccessLogGroup, 0, "")
+		if err != nil {
+			return err
+		}
+		ops = append(ops,
+			replace("/accessLogSettings/destinationArn", logGroupARN),
+			replace("/accessLogSettings/format", AccessLogFormat))
+	} else if stage.AccessLogSettings != nil && aws.StringValue(stage.AccessLogSettings.DestinationArn) != "" {
+		ops = append(ops, remove("/accessLogSettings"))
+	}
+
+	// Stage variables
+	for name, value := range settings.Variables {
+		ops = append(ops, replace("/variables/"+name, value))
+	}
+	for name := range stage.Variables {
+		if _, found := settings.Variables[name]; !found {
+			ops = append(ops, remove("/variables/"+name))
+		}
+	}
+
+	fmt.Printf("Configuring stage %s\n", cfg.Resources.gatewayStage)
+	_, err = g.UpdateStage(&apigateway.UpdateStageInput{
+		RestApiId:       aws.String(cfg.Resources.gatewayID),
+		StageName:       aws.String(cfg.Resources.gatewayStage),
+		PatchOperations: ops,
+	})
+	return err
+}
+
+// GatewayLoggingRoleName is the role API Gateway writes execution logs with.
+// It is an account wide setting, so goflake only creates it when the account
+// has none.
+const GatewayLoggingRoleName = "goflake-apigateway-cloudwatch"
+
+// ensureGatewayLoggingRole makes sure API Gateway may write execution logs in
+// this region, which UpdateStage otherwise rejects.
+func (cfg *AWSConfig) ensureGatewayLoggingRole(g *apigateway.APIGateway) error {
+	account, err := g.GetAccount(&apigateway.GetAccountInput{})
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(account.CloudwatchRoleArn) != "" {
+		return nil
+	}
+	if !cfg.prompt.AskYesNo(fmt.Sprintf("Logging needs an account wide CloudWatch role for API Gateway, would you like to create %s?", GatewayLoggingRoleName)) {
+		return fmt.Errorf("execution and access logging require API Gateway's CloudWatch role to be set in the account settings")
+	}
+
+	i := iam.New(cfg.awsSession)
+	trust, err := NewPolicyDocument(Statement{
+		Effect:    EffectAllow,
+		Principal: &Principal{Service: StringList{"apigateway.amazonaws.com"}},
+		Action:    StringList{"sts:AssumeRole"},
+	}).JSON()
+	if err != nil {
+		return err
+	}
+	role, err := i.CreateRole(&iam.CreateRoleInput{
+		RoleName:                 aws.String(GatewayLoggingRoleName),
+		AssumeRolePolicyDocument: aws.String(trust),
+		Tags:                     cfg.iamTags(),
+	})
+	var roleARN string
+	switch {
+	case err == nil:
+		roleARN = aws.StringValue(role.Role.Arn)
+	case isAWSErrorCode(err, iam.ErrCodeEntityAlreadyExistsException):
+		existing, err := i.GetRole(&iam.GetRoleInput{RoleName: aws.String(GatewayLoggingRoleName)})
+		if err != nil {
+			return err
+		}
+		roleARN = aws.StringValue(existing.Role.Arn)
+	default:
+		return err
+	}
+	_, err = i.AttachRolePolicy(&iam.AttachRolePolicyInput{
+		RoleName:  aws.String(GatewayLoggingRoleName),
+		PolicyArn: aws.String(cfg.arn("iam", "", "aws", "policy/service-role/AmazonAPIGatewayPushToCloudWatchLogs")),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Waiting 15s for role to propagate")
+	time.Sleep(15 * time.Second)
+	_, err = g.UpdateAccount(&apigateway.UpdateAccountInput{
+		PatchOperations: []*apigateway.PatchOperation{
+			{
+				Op:    aws.String("replace"),
+				Path:  aws.String("/cloudwatchRoleArn"),
+				Value: aws.String(roleARN),
+			},
+		},
+	})
+	return err
+}
+
+// stageARN identifies a stage of a REST API, e.g. for WAF.
+func (cfg *AWSConfig) stageARN(apiID string, stage string) string {
+	return cfg.restAPIARN(apiID) + "/stages/" + stage
+}
@@ -0,0 +1,113 @@
+package externalfunction
+
+import (
+	"strings"
+	"testing"
+)
+
+// partitionConfig is an AWS provider planned for region, as far as building
+// ARNs, URLs and policies goes.
+func partitionConfig(region string) *AWSConfig {
+	cfg := &AWSConfig{
+		region:      region,
+		awsAccount:  "123456789012",
+		extFuncName: "echo",
+		Resources: &AWSResources{
+			lambdaFuncName:  "echo-lambda",
+			gatewayID:       "abc123",
+			gatewayName:     "echo-gateway",
+			gatewayRoleName: "echo-gateway-role",
+			gatewayRoleARN:  "arn:aws:iam::123456789012:role/echo-gateway-role",
+			gatewayStage:    "prod",
+			gatewayEndpoint: "https://abc123.execute-api." + region + ".amazonaws.com/prod/",
+		},
+	}
+	cfg.partition, cfg.dnsSuffix = awsPartition(region)
+	return cfg
+}
+
+func TestPartitions(t *testing.T) {
+	tests := []struct {
+		region      string
+		partition   string
+		dnsSuffix   string
+		console     string
+		apiProvider string
+	}{
+		{"us-east-1", "aws", "amazonaws.com", "console.aws.amazon.com", "aws_api_gateway"},
+		{"eu-west-1", "aws", "amazonaws.com", "console.aws.amazon.com", "aws_api_gateway"},
+		{"us-gov-west-1", "aws-us-gov", "amazonaws.com", "console.amazonaws-us-gov.com", "aws_gov_api_gateway"},
+		{"cn-north-1", "aws-cn", "amazonaws.com.cn", "console.amazonaws.cn", "aws_api_gateway"},
+		{"unknown-region-1", "aws", "amazonaws.com", "console.aws.amazon.com", "aws_api_gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			cfg := partitionConfig(tt.region)
+			if cfg.partition != tt.partition || cfg.dnsSuffix != tt.dnsSuffix {
+				t.Fatalf("awsPartition(%q) = %q, %q, want %q, %q", tt.region, cfg.partition, cfg.dnsSuffix, tt.partition, tt.dnsSuffix)
+			}
+			if got := consoleHost(cfg.partition); got != tt.console {
+				t.Errorf("consoleHost(%q) = %q, want %q", cfg.partition, got, tt.console)
+			}
+
+			p := tt.partition
+			arns := map[string]string{
+				"gatewayExecuteARN":   cfg.gatewayExecuteARN(),
+				"snowflakeSessionARN": cfg.snowflakeSessionARN(),
+				"restAPIARN":          cfg.restAPIARN("abc123"),
+				"stageARN":            cfg.stageARN("abc123", "prod"),
+				"lambdaLogGroupARN":   cfg.lambdaLogGroupARN(),
+				"alarm":               cfg.arn("cloudwatch", tt.region, cfg.awsAccount, "alarm:"+cfg.alarmName("lambda-errors")),
+			}
+			want := map[string]string{
+				"gatewayExecuteARN":   "arn:" + p + ":execute-api:" + tt.region + ":123456789012:abc123/*",
+				"snowflakeSessionARN": "arn:" + p + ":sts::123456789012:assumed-role/echo-gateway-role/snowflake",
+				"restAPIARN":          "arn:" + p + ":apigateway:" + tt.region + "::/restapis/abc123",
+				"stageARN":            "arn:" + p + ":apigateway:" + tt.region + "::/restapis/abc123/stages/prod",
+				"lambdaLogGroupARN":   "arn:" + p + ":logs:" + tt.region + ":123456789012:log-group:/aws/lambda/echo-lambda",
+				"alarm":               "arn:" + p + ":cloudwatch:" + tt.region + ":123456789012:alarm:goflake-echo-lambda-errors",
+			}
+			for name, got := range arns {
+				if got != want[name] {
+					t.Errorf("%s = %q, want %q", name, got, want[name])
+				}
+			}
+
+			sql := cfg.IntegrationSQL("echo_api_integration")
+			if !strings.Contains(sql, "api_provider = "+tt.apiProvider+"\n") {
+				t.Errorf("IntegrationSQL uses the wrong api_provider, want %s:\n%s", tt.apiProvider, sql)
+			}
+			cfg.Resources.gatewayPrivate = true
+			private := strings.Replace(tt.apiProvider, "_api_gateway", "_private_api_gateway", 1)
+			if sql := cfg.IntegrationSQL("echo_api_integration"); !strings.Contains(sql, "api_provider = "+private+"\n") {
+				t.Errorf("IntegrationSQL uses the wrong private api_provider, want %s:\n%s", private, sql)
+			}
+		})
+	}
+}
+
+func TestPartitionPolicies(t *testing.T) {
+	for _, region := range []string{"us-east-1", "us-gov-west-1", "cn-north-1"} {
+		t.Run(region, func(t *testing.T) {
+			cfg := partitionConfig(region)
+			documents := map[string]*PolicyDocument{
+				GatewayInvokePolicyName:   GatewayInvokePolicy(cfg.gatewayExecuteARN()),
+				APIResourcePolicyName:     APIResourcePolicy(cfg.snowflakeSessionARN(), cfg.gatewayExecuteARN(), []string{"vpce-1"}, []string{"203.0.113.0/24"}),
+				LambdaExecutionPolicyName: LambdaExecutionPolicy(cfg.lambdaLogGroupARN(), LambdaPermissions{}),
+				GatewayTrustPolicyName:    GatewayBootstrapTrustPolicy(cfg.arn("iam", "", cfg.awsAccount, "root")),
+			}
+			for name, d := range documents {
+				doc, err := d.JSON()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				// Every ARN in the document belongs to the region's partition
+				for _, field := range strings.Split(doc, `"`) {
+					if strings.HasPrefix(field, "arn:") && !strings.HasPrefix(field, "arn:"+cfg.partition+":") {
+						t.Errorf("%s: %s is not in partition %s", name, field, cfg.partition)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package externalfunction
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// The gateway role's trust is bootstrapped in two phases, because the
+// Snowflake identity it must trust only exists once the API integration -
+// which itself needs the role's ARN - has been created:
+//
+//  1. BootstrapGatewayRole creates the role trusting only its own account
+//     with a placeholder external id, so the integration can reference it.
+//  2. TrustSnowflake, once `describe integration` has reported
+//     API_AWS_IAM_USER_ARN and API_AWS_EXTERNAL_ID, replaces the placeholder
+//     with a statement for Snowflake's IAM user and external id.
+//
+// Every Snowflake account gets its own trust statement, so several accounts
+// can share the gateway: re-running goflake from another account adds its
+// statement, and RevokeTrust removes one without disturbing the others. When
+// an integration is recreated with a new external id, its account's statement
+// is updated in place (see RepairTrust).
+//
+// Each phase reads the trust back to verify it, and no phase ever lets an
+// AWS service (lambda included) assume the gateway role.
+
+// BootstrapGatewayRole is phase one of the gateway role's trust. An existing
+// role keeps its trust so that re-running goflake does not lock out a working
+// integration, unless that trust lets a service assume the role.
+func (cfg *AWSConfig) BootstrapGatewayRole(i *iam.IAM) error {
+	roleName := cfg.Resources.gatewayRoleName
+	placeholder := GatewayBootstrapTrustPolicy(cfg.arn("iam", "", cfg.awsAccount, "root"))
+	trust, roleARN, err := cfg.roleTrust(i, roleName)
+
+	switch {
+	case isAWSErrorCode(err, iam.ErrCodeNoSuchEntityException):
+		doc, err := placeholder.JSON()
+		if err != nil {
+			return err
+		}
+		roleInput := &iam.CreateRoleInput{
+			RoleName:                 aws.String(roleName),
+			AssumeRolePolicyDocument: aws.String(doc),
+			Tags:                     cfg.iamTags(),
+		}
+		if cfg.prompt.AskYesNo("Do you wish to include a Permission Boundary?") {
+			permissionBoundary := cfg.prompt.PromptString("What is the ARN of the boundary you'd like to attach to this role?", false, "")
+			roleInput.SetPermissionsBoundary(permissionBoundary)
+		}
+		_, err = i.CreateRole(roleInput)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case trust.trustsService():
+		fmt.Printf("Role %s can be assumed by an AWS service, resetting its trust\n", roleName)
+		err = cfg.updateRoleTrust(i, roleName, placeholder)
+		if err != nil {
+			return err
+		}
+		err = cfg.tagRole(i, roleName)
+		if err != nil {
+			return err
+		}
+	default:
+		cfg.Resources.gatewayRoleARN = roleARN
+		return cfg.tagRole(i, roleName)
+	}
+
+	trust, roleARN, err = cfg.roleTrust(i, roleName)
+	if err != nil {
+		return err
+	}
+	if !trust.trusts(cfg.arn("iam", "", cfg.awsAccount, "root"), PlaceholderExternalID) || trust.trustsService() {
+		return fmt.Errorf("role %s does not have the expected bootstrap trust", roleName)
+	}
+	cfg.Resources.gatewayRoleARN = roleARN
+	return nil
+}
+
+// TrustSnowflake is phase two of the gateway role's trust: Snowflake's IAM
+// user presenting the integration's external id may assume the role, next to
+// any other Snowflake accounts already trusted.
+func (cfg *AWSConfig) TrustSnowflake(i *iam.IAM, iamUserARN string, externalID string) error {
+	if !strings.HasPrefix(iamUserARN, "arn:") || externalID == "" || externalID == PlaceholderExternalID {
+		return fmt.Errorf("the integration reported an unusable IAM user %q / external id %q", iamUserARN, externalID)
+	}
+	roleName := cfg.Resources.gatewayRoleName
+	trust, _, err := cfg.roleTrust(i, roleName)
+	if err != nil {
+		return err
+	}
+	trust.RemoveStatement(InvokerTrustSid)
+	for _, old := range trust.AddSnowflakeTrust(iamUserARN, externalID) {
+		fmt.Printf("The integration's external id changed from %s to %s, updating role %s\n", old, externalID, roleName)
+	}
+	err = cfg.updateRoleTrust(i, roleName, trust)
+	if err != nil {
+		return err
+	}
+
+	trust, _, err = cfg.roleTrust(i, roleName)
+	if err != nil {
+		return err
+	}
+	if !trust.trusts(iamUserARN, externalID) || trust.trustsService() {
+		return fmt.Errorf("role %s does not trust %s with the integration's external id", roleName, iamUserARN)
+	}
+	return nil
+}
+
+// RepairTrust re-trusts the integration's IAM user and external id when the
+// gateway role's trust has drifted from them, e.g. because the integration was
+// recreated, and reports whether it had.
+func (cfg *AWSConfig) RepairTrust(externalID string, iamUser string) (bool, error) {
+	i := iam.New(cfg.awsSession)
+	trust, _, err := cfg.roleTrust(i, cfg.Resources.gatewayRoleName)
+	if err != nil {
+		return false, err
+	}
+	// A statement left behind by an interrupted invoke is dropped too
+	if trust.trusts(iamUser, externalID) && !trust.trustsService() && !trust.RemoveStatement(InvokerTrustSid) {
+		return false, nil
+	}
+	return true, cfg.TrustSnowflake(i, iamUser, externalID)
+}
+
+// RevokeTrust removes one Snowflake account's statement from the gateway
+// role's trust. When it was the last one, the role goes back to the bootstrap
+// trust rather than to an empty (invalid) trust policy.
+func (cfg *AWSConfig) RevokeTrust(externalID string, iamUser string) error {
+	if cfg.awsAccount == "" {
+		if err := cfg.SetCurrentAccountID(); err != nil {
+			return err
+		}
+	}
+	i := iam.New(cfg.awsSession)
+	roleName := cfg.Resources.gatewayRoleName
+	trust, _, err := cfg.roleTrust(i, roleName)
+	if err != nil {
+		return err
+	}
+	if !trust.RemoveSnowflakeTrust(externalID) {
+		fmt.Printf("Role %s does not trust external id %s, nothing to revoke\n", roleName, externalID)
+		return nil
+	}
+	if len(trust.SnowflakeTrusts()) == 0 {
+		trust.RemoveStatement(BootstrapTrustSid)
+		trust.Statement = append(trust.Statement, GatewayBootstrapTrustPolicy(cfg.arn("iam", "", cfg.awsAccount, "root")).Statement...)
+	}
+	err = cfg.updateRoleTrust(i, roleName, trust)
+	if err != nil {
+		return err
+	}
+
+	trust, _, err = cfg.roleTrust(i, roleName)
+	if err != nil {
+		return err
+	}
+	if trust.trusts(iamUser, externalID) {
+		return fmt.Errorf("role %s still trusts %s with external id %s", roleName, iamUser, externalID)
+	}
+	return nil
+}
+
+// roleTrust returns the role's trust policy and ARN.
+func (cfg *AWSConfig) roleTrust(i *iam.IAM, roleName string) (*PolicyDocument, string, error) {
+	r, err := i.GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// IAM returns policy documents URL encoded
+	doc, err := url.QueryUnescape(aws.StringValue(r.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return nil, "", err
+	}
+	trust, err := ParsePolicyDocument(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	return trust, aws.StringValue(r.Role.Arn), nil
+}
+
+func (cfg *AWSConfig) updateRoleTrust(i *iam.IAM, roleName string, trust *PolicyDocument) error {
+	doc, err := trust.JSON()
+	if err != nil {
+		return err
+	}
+	_, err = i.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+		PolicyDocument: aws.String(doc),
+		RoleName:       aws.String(roleName),
+	})
+	return err
+}
@@ -0,0 +1,315 @@
+package externalfunction
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+func (cfg *AWSConfig) webACLName() string {
+	return cfg.Resources.gatewayName + "-waf"
+}
+
+func (cfg *AWSConfig) ipSetName() string {
+	return cfg.Resources.gatewayName + "-snowflake-egress"
+}
+
+// AssociateWebACL puts the spec's web ACL, or one goflake creates allowing
+// only Snowflake's egress ranges, in front of the deployed stage.
+func (cfg *AWSConfig) AssociateWebACL() error {
+	w := wafv2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	webACLARN := spec.Gateway.WAF.WebACLARN
+	if webACLARN == "" {
+		var err error
+		webACLARN, err = cfg.ensureWebACL(w)
+		if err != nil {
+			return err
+		}
+	}
+	stageARN := cfg.stageARN(cfg.Resources.gatewayID, cfg.Resources.gatewayStage)
+
+	current, err := w.GetWebACLForResource(&wafv2.GetWebACLForResourceInput{ResourceArn: aws.String(stageARN)})
+	if err != nil {
+		return err
+	}
+	// Remember what goflake associated, so it can be undone once the web
+	// ACL is dropped from the spec
+	g := apigateway.New(cfg.awsSession, cfg.Resources.regionConfig)
+	_, err = g.TagResource(&apigateway.TagResourceInput{
+		ResourceArn: aws.String(stageARN),
+		Tags:        map[string]*string{WebACLTagKey: aws.String(webACLARN)},
+	})
+	if err != nil {
+		return err
+	}
+	if current.WebACL != nil && aws.StringValue(current.WebACL.ARN) == webACLARN {
+		fmt.Printf("Web ACL %s protects stage %s\n", webACLARN, cfg.Resources.gatewayStage)
+		return nil
+	}
+
+	// A new web ACL takes a moment before it can be associated
+	for attempt := 1; ; attempt++ {
+		_, err = w.AssociateWebACL(&wafv2.AssociateWebACLInput{
+			ResourceArn: aws.String(stageARN),
+			WebACLArn:   aws.String(webACLARN),
+		})
+		if !isAWSErrorCode(err, wafv2.ErrCodeWAFUnavailableEntityException) || attempt == 6 {
+			break
+		}
+		fmt.Println("Waiting 10s for the web ACL to become available...")
+		time.Sleep(10 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Web ACL %s protects stage %s\n", webACLARN, cfg.Resources.gatewayStage)
+	return nil
+}
+
+// WebACLTagKey tags the stage with the web ACL goflake associated with it.
+const WebACLTagKey = "goflake:web-acl"
+
+// RemoveWebACL undoes AssociateWebACL once gateway.waf is dropped from the
+// spec: the web ACL goflake associated is disassociated from the stage, and
+// deleted when goflake created it and nothing else uses it.
+func (cfg *AWSConfig) RemoveWebACL(g *apigateway.APIGateway) error {
+	stage, err := g.GetStage(&apigateway.GetStageInput{
+		RestApiId: aws.String(cfg.Resources.gatewayID),
+		StageName: aws.String(cfg.Resources.gatewayStage),
+	})
+	if err != nil {
+		return err
+	}
+	associated := aws.StringValue(stage.Tags[WebACLTagKey])
+	if associated == "" {
+		return nil
+	}
+	stageARN := cfg.stageARN(cfg.Resources.gatewayID, cfg.Resources.gatewayStage)
+
+	w := wafv2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	current, err := w.GetWebACLForResource(&wafv2.GetWebACLForResourceInput{ResourceArn: aws.String(stageARN)})
+	if err != nil {
+		return err
+	}
+	if current.WebACL != nil && aws.StringValue(current.WebACL.ARN) == associated {
+		fmt.Printf("Disassociating web ACL %s from stage %s\n", aws.StringValue(current.WebACL.Name), cfg.Resources.gatewayStage)
+		_, err = w.DisassociateWebACL(&wafv2.DisassociateWebACLInput{ResourceArn: aws.String(stageARN)})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = g.UntagResource(&apigateway.UntagResourceInput{
+		ResourceArn: aws.String(stageARN),
+		TagKeys:     []*string{aws.String(WebACLTagKey)},
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.deleteWebACL()
+}
+
+// ensureWebACL creates goflake's web ACL, which blocks everything but
+// Snowflake's egress ranges, or brings the ranges of an existing one up to
+// date, and returns its ARN.
+func (cfg *AWSConfig) ensureWebACL(w *wafv2.WAFV2) (string, error) {
+	ranges := spec.Gateway.WAF.AllowedIPRanges
+	if len(ranges) == 0 {
+		ranges = spec.Gateway.AllowedIPRanges
+	}
+	if len(ranges) == 0 {
+		return "", fmt.Errorf("gateway.waf needs a webAclArn, or Snowflake's egress ranges in allowedIpRanges")
+	}
+
+	ipSet, err := cfg.findIPSet(w)
+	if err != nil {
+		return "", err
+	}
+	var ipSetARN string
+	if ipSet == nil {
+		out, err := w.CreateIPSet(&wafv2.CreateIPSetInput{
+			Name:             aws.String(cfg.ipSetName()),
+			Scope:            aws.String(wafv2.ScopeRegional),
+			IPAddressVersion: aws.String(wafv2.IPAddressVersionIpv4),
+			Addresses:        aws.StringSlice(ranges),
+			Tags:             cfg.wafTags(),
+		})
+		if err != nil {
+			return "", err
+		}
+		ipSetARN = aws.StringValue(out.Summary.ARN)
+	} else {
+		current, err := w.GetIPSet(&wafv2.GetIPSetInput{Id: ipSet.Id, Name: ipSet.Name, Scope: aws.String(wafv2.ScopeRegional)})
+		if err != nil {
+			return "", err
+		}
+		_, err = w.UpdateIPSet(&wafv2.UpdateIPSetInput{
+			Id:        ipSet.Id,
+			Name:      ipSet.Name,
+			Scope:     aws.String(wafv2.ScopeRegional),
+			Addresses: aws.StringSlice(ranges),
+			LockToken: current.LockToken,
+		})
+		if err != nil {
+			return "", err
+		}
+		ipSetARN = aws.StringValue(ipSet.ARN)
+	}
+
+	webACL, err := cfg.findWebACL(w)
+	if err != nil {
+		return "", err
+	}
+	if webACL != nil {
+		return aws.StringValue(webACL.ARN), nil
+	}
+	metric := func(name string) *wafv2.VisibilityConfig {
+		return &wafv2.VisibilityConfig{
+			CloudWatchMetricsEnabled: aws.Bool(true),
+			MetricName:               aws.String(name),
+			SampledRequestsEnabled:   aws.Bool(true),
+		}
+	}
+	fmt.Printf("Creating web ACL %s\n", cfg.webACLName())
+	out, err := w.CreateWebACL(&wafv2.CreateWebACLInput{
+		Name:          aws.String(cfg.webACLName()),
+		Scope:         aws.String(wafv2.ScopeRegional),
+		DefaultAction: &wafv2.DefaultAction{Block: &wafv2.BlockAction{}},
+		Rules: []*wafv2.Rule{
+			{
+				Name:     aws.String("AllowSnowflakeEgress"),
+				Priority: aws.Int64(0),
+				Action:   &wafv2.RuleAction{Allow: &wafv2.AllowAction{}},
+				Statement: &wafv2.Statement{
+					IPSetReferenceStatement: &wafv2.IPSetReferenceStatement{ARN: aws.String(ipSetARN)},
+				},
+				VisibilityConfig: metric(sidSafe(cfg.webACLName()) + "AllowSnowflakeEgress"),
+			},
+		},
+		VisibilityConfig: metric(sidSafe(cfg.webACLName())),
+		Tags:             cfg.wafTags(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Summary.ARN), nil
+}
+
+func (cfg *AWSConfig) wafTags() []*wafv2.Tag {
+	var tags []*wafv2.Tag
+	for _, tag := range cfg.iamTags() {
+		tags = append(tags, &wafv2.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tags
+}
+
+func (cfg *AWSConfig) findWebACL(w *wafv2.WAFV2) (*wafv2.WebACLSummary, error) {
+	input := &wafv2.ListWebACLsInput{Scope: aws.String(wafv2.ScopeRegional)}
+	for {
+		out, err := w.ListWebACLs(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, acl := range out.WebACLs {
+			if aws.StringValue(acl.Name) == cfg.webACLName() {
+				return acl, nil
+			}
+		}
+		if aws.StringValue(out.NextMarker) == "" {
+			return nil, nil
+		}
+		input.NextMarker = out.NextMarker
+	}
+}
+
+func (cfg *AWSConfig) findIPSet(w *wafv2.WAFV2) (*wafv2.IPSetSummary, error) {
+	input := &wafv2.ListIPSetsInput{Scope: aws.String(wafv2.ScopeRegional)}
+	for {
+		out, err := w.ListIPSets(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range out.IPSets {
+			if aws.StringValue(set.Name) == cfg.ipSetName() {
+				return set, nil
+			}
+		}
+		if aws.StringValue(out.NextMarker) == "" {
+			return nil, nil
+		}
+		input.NextMarker = out.NextMarker
+	}
+}
+
+// disassociateWebACLs removes the web ACLs in front of the REST API's stages.
+func (cfg *AWSConfig) disassociateWebACLs(g *apigateway.APIGateway, apiID string) error {
+	w := wafv2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	stages, err := g.GetStages(&apigateway.GetStagesInput{RestApiId: aws.String(apiID)})
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages.Item {
+		stageARN := cfg.stageARN(apiID, aws.StringValue(stage.StageName))
+		current, err := w.GetWebACLForResource(&wafv2.GetWebACLForResourceInput{ResourceArn: aws.String(stageARN)})
+		if err != nil {
+			return err
+		}
+		if current.WebACL == nil {
+			continue
+		}
+		fmt.Printf("Disassociating web ACL %s from stage %s\n", aws.StringValue(current.WebACL.Name), aws.StringValue(stage.StageName))
+		_, err = w.DisassociateWebACL(&wafv2.DisassociateWebACLInput{ResourceArn: aws.String(stageARN)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteWebACL deletes the web ACL and IP set goflake created, if any, unless
+// the web ACL is still associated with a stage. Web ACLs passed in through the
+// spec are never deleted.
+func (cfg *AWSConfig) deleteWebACL() error {
+	w := wafv2.New(cfg.awsSession, cfg.Resources.regionConfig)
+	webACL, err := cfg.findWebACL(w)
+	if err != nil {
+		return err
+	}
+	if webACL != nil {
+		used, err := w.ListResourcesForWebACL(&wafv2.ListResourcesForWebACLInput{
+			WebACLArn:    webACL.ARN,
+			ResourceType: aws.String(wafv2.ResourceTypeApiGateway),
+		})
+		if err != nil {
+			return err
+		}
+		if len(used.ResourceArns) > 0 {
+			fmt.Printf("Keeping web ACL %s, which still protects %s\n", *webACL.Name, strings.Join(aws.StringValueSlice(used.ResourceArns), ", "))
+			return nil
+		}
+		fmt.Printf("Deleting web ACL %s\n", *webACL.Name)
+		_, err = w.DeleteWebACL(&wafv2.DeleteWebACLInput{
+			Id:        webACL.Id,
+			Name:      webACL.Name,
+			Scope:     aws.String(wafv2.ScopeRegional),
+			LockToken: webACL.LockToken,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	ipSet, err := cfg.findIPSet(w)
+	if err != nil || ipSet == nil {
+		return err
+	}
+	_, err = w.DeleteIPSet(&wafv2.DeleteIPSetInput{
+		Id:        ipSet.Id,
+		Name:      ipSet.Name,
+		Scope:     aws.String(wafv2.ScopeRegional),
+		LockToken: ipSet.LockToken,
+	})
+	return err
+}
@@ -0,0 +1,659 @@
+package externalfunction
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tampajohn/goflake/pkg/common"
+)
+
+const (
+	azureManagementURL = "https://management.azure.com"
+
+	azureStorageAPIVersion = "2022-09-01"
+	azureWebAPIVersion     = "2022-03-01"
+	azureAPIMAPIVersion    = "2022-08-01"
+
+	// AzureFunctionApp is the default Azure Function (python v2 programming model)
+	// that echoes its inputs back to Snowflake, mirroring the default lambda.
+	AzureFunctionApp = `import json
+
+import azure.functions as func
+
+app = func.FunctionApp(http_auth_level=func.AuthLevel.FUNCTION)
+
+
+@app.route(route="%s", methods=["POST"])
+def external_function(req: func.HttpRequest) -> func.HttpResponse:
+    rows_to_return = []
+    try:
+        rows = req.get_json()["data"]
+        for row in rows:
+            rows_to_return.append([row[0], ["Echoing inputs:"] + row[1:]])
+        return func.HttpResponse(json.dumps({"data": rows_to_return}), status_code=200)
+    except Exception:
+        return func.HttpResponse(req.get_body(), status_code=400)
+`
+
+	AzureFunctionHost = `{
+	"version": "2.0",
+	"extensionBundle": {
+		"id": "Microsoft.Azure.Functions.ExtensionBundle",
+		"version": "[4.*, 5.0.0)"
+	}
+}`
+
+	// AzureAPIPolicy is the API Management inbound policy; it validates the
+	// Azure AD token Snowflake presents and forwards the function key, which
+	// it references as a secret named value.
+	AzureAPIPolicy = `<policies>
+	<inbound>
+		<base />
+		<validate-jwt header-name="Authorization" failed-validation-httpcode="401" failed-validation-error-message="Unauthorized. Access token is missing or invalid.">
+			<openid-config url="https://login.microsoftonline.com/%s/.well-known/openid-configuration" />
+			<audiences>
+				<audience>%s</audience>
+				<audience>api://%s</audience>
+			</audiences>%s
+		</validate-jwt>
+		<set-header name="x-functions-key" exists-action="override">
+			<value>{{%s}}</value>
+		</set-header>
+	</inbound>
+	<backend>
+		<base />
+	</backend>
+	<outbound>
+		<base />
+	</outbound>
+	<on-error>
+		<base />
+	</on-error>
+</policies>`
+
+	AzureRequiredAppIDClaim = `
+			<required-claims>
+				<claim name="appid">
+					<value>%s</value>
+				</claim>
+			</required-claims>`
+)
+
+// azureClient is the subset of the Azure Resource Manager and Kudu APIs used
+// to provision external functions; it is satisfied by armClient and by fakes.
+type azureClient interface {
+	Put(resourceID string, apiVersion string, body interface{}, out interface{}) error
+	Post(resourceID string, apiVersion string, body interface{}, out interface{}) error
+	Get(resourceID string, apiVersion string, out interface{}) error
+	Delete(resourceID string, apiVersion string) error
+	ZipDeploy(siteName string, zipBytes []byte) error
+}
+
+// newAzureClient connects with an access token; tests replace it with a fake.
+var newAzureClient = func(token string) azureClient {
+	return newARMClient(token)
+}
+
+type AzureConfig struct {
+	client           azureClient
+	subscriptionID   string
+	tenantID         string
+	resourceGroup    string
+	location         string
+	adApplicationID  string
+	Resources        *AzureResources
+	extFuncName      string
+	extFuncSignature string
+	prompt           common.Prompter
+}
+
+type AzureResources struct {
+	storageAccountName string
+	planName           string
+	functionAppName    string
+	functionName       string
+	functionKey        string
+	functionZipBytes   []byte
+	apimName           string
+	apimPublisherEmail string
+	apimCreate         bool
+	apiName            string
+	apiPath            string
+	gatewayEndpoint    string
+	consentURL         string
+	multiTenantAppName string
+	snowflakeAppID     string
+}
+
+// NewAzureProvider returns an unplanned Azure provider.
+func NewAzureProvider(prompt common.Prompter) Provider {
+	return &AzureConfig{prompt: prompt, Resources: &AzureResources{}}
+}
+
+// The questions Plan and ApplyConsent ask, named so that answers can be
+// scripted.
+const (
+	azureUseEnvQuestion          = "Would you like to us to attempt to use your AZURE_[ACCESS_TOKEN|SUBSCRIPTION_ID|TENANT_ID] from your environment?"
+	azureResourceGroupQuestion   = "What existing resource group should the resources be created in?"
+	azureLocationQuestion        = "What location would you like to use?"
+	azureADApplicationQuestion   = "What is the Application (client) ID of the Azure AD app registration that represents the API?"
+	azureStorageAccountQuestion  = "What would you like the storage account to be named?"
+	azurePlanQuestion            = "What would you like the function app plan to be named?"
+	azureFunctionAppQuestion     = "What would you like the function app to be named?"
+	azureFunctionRouteQuestion   = "What route would you like the function to be served on?"
+	azureExistingAPIMQuestion    = "Would you like to use an existing API Management instance?"
+	azureAPIMNameQuestion        = "What is the name of the API Management instance?"
+	azurePublisherEmailQuestion  = "What publisher email should the API Management instance use?"
+	azureAPINameQuestion         = "What would you like the API to be named?"
+	azureAPIPathQuestion         = "What path would you like the API to be served on?"
+	azureDefaultFunctionQuestion = "Would you like to use the default azure function?"
+	azureConsentQuestion         = "Have you granted consent?"
+	azureSnowflakeAppQuestion    = "What is the Application ID of %s (Azure AD > Enterprise applications)?"
+)
+
+// Plan gathers credentials and the names of the function app, API
+// Management instance and API.
+func (cfg *AzureConfig) Plan(extFuncName string, extFuncSignature string) error {
+	cfg.extFuncName = extFuncName
+	cfg.extFuncSignature = extFuncSignature
+
+	var token string
+	if cfg.prompt.AskYesNo(azureUseEnvQuestion) {
+		// Attempt to get the azure creds from ENV; fail back to prompting the user
+		token = cfg.prompt.EnvOrString("AZURE_ACCESS_TOKEN", true)
+		cfg.subscriptionID = cfg.prompt.EnvOrString("AZURE_SUBSCRIPTION_ID", false)
+		cfg.tenantID = cfg.prompt.EnvOrString("AZURE_TENANT_ID", false)
+	} else {
+		// Just get the creds from the user (az account get-access-token)
+		token = cfg.prompt.PromptString("AZURE_ACCESS_TOKEN", true, "")
+		cfg.subscriptionID = cfg.prompt.PromptString("AZURE_SUBSCRIPTION_ID", false, "")
+		cfg.tenantID = cfg.prompt.PromptString("AZURE_TENANT_ID", false, "")
+	}
+	cfg.client = newAzureClient(token)
+
+	cfg.resourceGroup = cfg.prompt.PromptString(
+		azureResourceGroupQuestion,
+		false,
+		"")
+	cfg.location = cfg.prompt.PromptString(
+		azureLocationQuestion,
+		false,
+		"eastus")
+	cfg.adApplicationID = cfg.prompt.PromptString(
+		azureADApplicationQuestion,
+		false,
+		"")
+
+	// Azure storage account names are 3-24 lowercase alphanumerics
+	storageName := strings.ToLower(strings.Replace(extFuncName, "_", "", -1)) + "sa"
+	if len(storageName) > 24 {
+		storageName = storageName[:24]
+	}
+	cfg.Resources.storageAccountName = cfg.prompt.PromptString(
+		azureStorageAccountQuestion,
+		false,
+		storageName)
+	cfg.Resources.planName = cfg.prompt.PromptString(
+		azurePlanQuestion,
+		false,
+		extFuncName+"-plan")
+	cfg.Resources.functionAppName = cfg.prompt.PromptString(
+		azureFunctionAppQuestion,
+		false,
+		strings.Replace(extFuncName, "_", "-", -1)+"-func")
+	cfg.Resources.functionName = cfg.prompt.PromptString(
+		azureFunctionRouteQuestion,
+		false,
+		extFuncName)
+	cfg.Resources.apimCreate = !cfg.prompt.AskYesNo(azureExistingAPIMQuestion)
+	cfg.Resources.apimName = cfg.prompt.PromptString(
+		azureAPIMNameQuestion,
+		false,
+		strings.Replace(extFuncName, "_", "-", -1)+"-apim")
+	if cfg.Resources.apimCreate {
+		cfg.Resources.apimPublisherEmail = cfg.prompt.PromptString(
+			azurePublisherEmailQuestion,
+			false,
+			"")
+	}
+	cfg.Resources.apiName = cfg.prompt.PromptString(
+		azureAPINameQuestion,
+		false,
+		extFuncName+"-api")
+	cfg.Resources.apiPath = cfg.prompt.PromptString(
+		azureAPIPathQuestion,
+		false,
+		extFuncName)
+
+	if cfg.prompt.AskYesNo(azureDefaultFunctionQuestion) {
+		functionData, err := defaultAzureFunctionZip(cfg.Resources.functionName)
+		if err != nil {
+			return err
+		}
+		cfg.Resources.functionZipBytes = functionData
+	} else {
+		data, err := promptZipFile(cfg.prompt)
+		if err != nil {
+			return err
+		}
+		cfg.Resources.functionZipBytes = data
+	}
+
+	return nil
+}
+
+// defaultAzureFunctionZip packages AzureFunctionApp as a deployable zip
+// serving on the given route.
+func defaultAzureFunctionZip(route string) ([]byte, error) {
+	return zipSource(map[string]string{
+		"function_app.py":  fmt.Sprintf(AzureFunctionApp, route),
+		"host.json":        AzureFunctionHost,
+		"requirements.txt": "azure-functions\n",
+	})
+}
+
+func (cfg *AzureConfig) resourceGroupID() string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", cfg.subscriptionID, cfg.resourceGroup)
+}
+
+func (cfg *AzureConfig) storageAccountID() string {
+	return cfg.resourceGroupID() + "/providers/Microsoft.Storage/storageAccounts/" + cfg.Resources.storageAccountName
+}
+
+func (cfg *AzureConfig) planID() string {
+	return cfg.resourceGroupID() + "/providers/Microsoft.Web/serverfarms/" + cfg.Resources.planName
+}
+
+func (cfg *AzureConfig) functionAppID() string {
+	return cfg.resourceGroupID() + "/providers/Microsoft.Web/sites/" + cfg.Resources.functionAppName
+}
+
+func (cfg *AzureConfig) apimID() string {
+	return cfg.resourceGroupID() + "/providers/Microsoft.ApiManagement/service/" + cfg.Resources.apimName
+}
+
+// functionKeyID is the secret named value holding the function key.
+func (cfg *AzureConfig) functionKeyID() string {
+	return cfg.apimID() + "/namedValues/" + cfg.functionKeyName()
+}
+
+func (cfg *AzureConfig) functionKeyName() string {
+	return cfg.Resources.functionAppName + "-key"
+}
+
+func (cfg *AzureConfig) apiID() string {
+	return cfg.apimID() + "/apis/" + cfg.Resources.apiName
+}
+
+func (cfg *AzureConfig) CreateStorageAccount() error {
+	return cfg.client.Put(cfg.storageAccountID(), azureStorageAPIVersion, map[string]interface{}{
+		"location": cfg.location,
+		"kind":     "StorageV2",
+		"sku":      map[string]string{"name": "Standard_LRS"},
+	}, nil)
+}
+
+func (cfg *AzureConfig) CreateOrConfigureFunctionApp() error {
+	var keys struct {
+		Keys []struct {
+			Value string `json:"value"`
+		} `json:"keys"`
+	}
+	err := cfg.client.Post(cfg.storageAccountID()+"/listKeys", azureStorageAPIVersion, nil, &keys)
+	if err != nil {
+		return err
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("storage account %s returned no keys", cfg.Resources.storageAccountName)
+	}
+	connection := fmt.Sprintf("DefaultEndpointsProtocol=https;AccountName=%s;AccountKey=%s;EndpointSuffix=core.windows.net",
+		cfg.Resources.storageAccountName, keys.Keys[0].Value)
+
+	err = cfg.client.Put(cfg.planID(), azureWebAPIVersion, map[string]interface{}{
+		"location":   cfg.location,
+		"kind":       "functionapp",
+		"sku":        map[string]string{"name": "Y1", "tier": "Dynamic"},
+		"properties": map[string]interface{}{"reserved": true},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.client.Put(cfg.functionAppID(), azureWebAPIVersion, map[string]interface{}{
+		"location": cfg.location,
+		"kind":     "functionapp,linux",
+		"properties": map[string]interface{}{
+			"serverFarmId": cfg.planID(),
+			"reserved":     true,
+			"httpsOnly":    true,
+			"siteConfig": map[string]interface{}{
+				"linuxFxVersion": "Python|3.10",
+				"appSettings": []map[string]string{
+					{"name": "AzureWebJobsStorage", "value": connection},
+					{"name": "FUNCTIONS_EXTENSION_VERSION", "value": "~4"},
+					{"name": "FUNCTIONS_WORKER_RUNTIME", "value": "python"},
+					{"name": "AzureWebJobsFeatureFlags", "value": "EnableWorkerIndexing"},
+					{"name": "SCM_DO_BUILD_DURING_DEPLOYMENT", "value": "true"},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.client.ZipDeploy(cfg.Resources.functionAppName, cfg.Resources.functionZipBytes)
+	if err != nil {
+		return err
+	}
+
+	var hostKeys struct {
+		FunctionKeys map[string]string `json:"functionKeys"`
+	}
+	err = cfg.client.Post(cfg.functionAppID()+"/host/default/listkeys", azureWebAPIVersion, nil, &hostKeys)
+	if err != nil {
+		return err
+	}
+	cfg.Resources.functionKey = hostKeys.FunctionKeys["default"]
+	return nil
+}
+
+func (cfg *AzureConfig) CreateAPIManagement() error {
+	if cfg.Resources.apimCreate {
+		fmt.Println("Creating API Management instance, this can take up to an hour...")
+		err := cfg.client.Put(cfg.apimID(), azureAPIMAPIVersion, map[string]interface{}{
+			"location": cfg.location,
+			"sku":      map[string]interface{}{"name": "Consumption", "capacity": 0},
+			"properties": map[string]string{
+				"publisherEmail": cfg.Resources.apimPublisherEmail,
+				"publisherName":  cfg.Resources.apimName,
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var svc struct {
+		Properties struct {
+			GatewayURL string `json:"gatewayUrl"`
+		} `json:"properties"`
+	}
+	err := cfg.client.Get(cfg.apimID(), azureAPIMAPIVersion, &svc)
+	if err != nil {
+		return err
+	}
+	cfg.Resources.gatewayEndpoint = fmt.Sprintf("%s/%s", svc.Properties.GatewayURL, cfg.Resources.apiPath)
+
+	err = cfg.client.Put(cfg.apiID(), azureAPIMAPIVersion, map[string]interface{}{
+		"properties": map[string]interface{}{
+			"displayName":          cfg.Resources.apiName,
+			"path":                 cfg.Resources.apiPath,
+			"protocols":            []string{"https"},
+			"subscriptionRequired": false,
+			"serviceUrl": fmt.Sprintf("https://%s.azurewebsites.net/api/%s",
+				cfg.Resources.functionAppName, cfg.Resources.functionName),
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.client.Put(cfg.apiID()+"/operations/post", azureAPIMAPIVersion, map[string]interface{}{
+		"properties": map[string]string{
+			"displayName": "post",
+			"method":      "POST",
+			"urlTemplate": "/",
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.client.Put(cfg.functionKeyID(), azureAPIMAPIVersion, map[string]interface{}{
+		"properties": map[string]interface{}{
+			"displayName": cfg.functionKeyName(),
+			"value":       cfg.Resources.functionKey,
+			"secret":      true,
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return cfg.ApplyAPIPolicy()
+}
+
+// ApplyAPIPolicy (re)writes the validate-jwt policy on the API. Until consent
+// has been granted the Snowflake app ID is unknown, so only the audience is
+// enforced.
+func (cfg *AzureConfig) ApplyAPIPolicy() error {
+	claims := ""
+	if cfg.Resources.snowflakeAppID != "" {
+		claims = fmt.Sprintf(AzureRequiredAppIDClaim, cfg.Resources.snowflakeAppID)
+	}
+	return cfg.client.Put(cfg.apiID()+"/policies/policy", azureAPIMAPIVersion, map[string]interface{}{
+		"properties": map[string]string{
+			"format": "rawxml",
+			"value": fmt.Sprintf(AzureAPIPolicy,
+				cfg.tenantID,
+				cfg.adApplicationID,
+				cfg.adApplicationID,
+				claims,
+				cfg.functionKeyName()),
+		},
+	}, nil)
+}
+
+// Provision creates the storage account, function app and API Management API.
+func (cfg *AzureConfig) Provision() error {
+	err := cfg.CreateStorageAccount()
+	if err != nil {
+		return err
+	}
+
+	err = cfg.CreateOrConfigureFunctionApp()
+	if err != nil {
+		return err
+	}
+
+	return cfg.CreateAPIManagement()
+}
+
+func (cfg *AzureConfig) Endpoint() string {
+	return cfg.Resources.gatewayEndpoint
+}
+
+func (cfg *AzureConfig) IntegrationSQL(integration string) string {
+	return fmt.Sprintf(`create api integration if not exists %s
+	api_provider = azure_api_management
+	azure_tenant_id = '%s'
+	azure_ad_application_id = '%s'
+	api_allowed_prefixes = ('%s')
+	enabled = true;`,
+		integration,
+		cfg.tenantID,
+		cfg.adApplicationID,
+		cfg.Resources.gatewayEndpoint)
+}
+
+func (cfg *AzureConfig) IntegrationUpdateSQL(integration string) string {
+	return fmt.Sprintf(`alter api integration %s set
+	azure_ad_application_id = '%s'
+	api_allowed_prefixes = ('%s')
+	enabled = true;`,
+		integration,
+		cfg.adApplicationID,
+		cfg.Resources.gatewayEndpoint)
+}
+
+// ApplyConsent walks the user through granting consent to Snowflake's
+// multi-tenant app and locks the API down to that app.
+func (cfg *AzureConfig) ApplyConsent(consentURL string, multiTenantAppName string) error {
+	cfg.Resources.consentURL = consentURL
+	cfg.Resources.multiTenantAppName = multiTenantAppName
+
+	fmt.Printf("Snowflake needs consent to request tokens in tenant %s.\n", cfg.tenantID)
+	fmt.Printf("Open the following URL as a tenant admin and accept the requested permissions:\n\n\t%s\n\n", cfg.Resources.consentURL)
+	if !cfg.prompt.AskYesNo(azureConsentQuestion) {
+		return fmt.Errorf("consent for %s is required before the API can be secured", cfg.Resources.multiTenantAppName)
+	}
+	cfg.Resources.snowflakeAppID = cfg.prompt.PromptString(
+		fmt.Sprintf(azureSnowflakeAppQuestion, cfg.Resources.multiTenantAppName),
+		false,
+		"")
+
+	return cfg.ApplyAPIPolicy()
+}
+
+// Destroy deletes the API with the function key's named value and the
+// function app with its plan and storage account. The API Management instance
+// is only deleted if goflake created it.
+func (cfg *AzureConfig) Destroy() error {
+	ids := [][2]string{
+		{cfg.apiID(), azureAPIMAPIVersion},
+		{cfg.functionKeyID(), azureAPIMAPIVersion},
+	}
+	if cfg.Resources.apimCreate {
+		ids = append(ids, [2]string{cfg.apimID(), azureAPIMAPIVersion})
+	}
+	ids = append(ids,
+		[2]string{cfg.functionAppID(), azureWebAPIVersion},
+		[2]string{cfg.planID(), azureWebAPIVersion},
+		[2]string{cfg.storageAccountID(), azureStorageAPIVersion})
+	for _, id := range ids {
+		fmt.Printf("Deleting %s\n", id[0])
+		err := cfg.client.Delete(id[0], id[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// armClient talks to Azure Resource Manager with a bearer token, e.g. the
+// output of `az account get-access-token`.
+type armClient struct {
+	token      string
+	baseURL    string
+	httpClient *http.Client
+	pollEvery  time.Duration
+	pollFor    time.Duration
+}
+
+func newARMClient(token string) *armClient {
+	return &armClient{
+		token:      token,
+		baseURL:    azureManagementURL,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		pollEvery:  15 * time.Second,
+		pollFor:    90 * time.Minute,
+	}
+}
+
+func (c *armClient) do(method string, url string, contentType string, body []byte, out interface{}) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s returned %d: %s", method, url, resp.StatusCode, data)
+	}
+	if out != nil && len(data) > 0 {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *armClient) url(resourceID string, apiVersion string) string {
+	return fmt.Sprintf("%s%s?api-version=%s", c.baseURL, resourceID, apiVersion)
+}
+
+func (c *armClient) send(method string, resourceID string, apiVersion string, body interface{}, out interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.do(method, c.url(resourceID, apiVersion), "application/json", data, out)
+}
+
+// Put creates or updates a resource and waits for it to finish provisioning.
+func (c *armClient) Put(resourceID string, apiVersion string, body interface{}, out interface{}) error {
+	_, err := c.send(http.MethodPut, resourceID, apiVersion, body, out)
+	if err != nil {
+		return err
+	}
+	return c.waitForProvisioning(resourceID, apiVersion)
+}
+
+func (c *armClient) Post(resourceID string, apiVersion string, body interface{}, out interface{}) error {
+	_, err := c.send(http.MethodPost, resourceID, apiVersion, body, out)
+	return err
+}
+
+func (c *armClient) Get(resourceID string, apiVersion string, out interface{}) error {
+	_, err := c.send(http.MethodGet, resourceID, apiVersion, nil, out)
+	return err
+}
+
+func (c *armClient) Delete(resourceID string, apiVersion string) error {
+	status, err := c.send(http.MethodDelete, resourceID, apiVersion, nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (c *armClient) waitForProvisioning(resourceID string, apiVersion string) error {
+	deadline := time.Now().Add(c.pollFor)
+	for {
+		var r struct {
+			Properties struct {
+				ProvisioningState string `json:"provisioningState"`
+			} `json:"properties"`
+		}
+		err := c.Get(resourceID, apiVersion, &r)
+		if err != nil {
+			return err
+		}
+		switch r.Properties.ProvisioningState {
+		case "", "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			return fmt.Errorf("provisioning %s ended in state %s", resourceID, r.Properties.ProvisioningState)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to provision", resourceID)
+		}
+		time.Sleep(c.pollEvery)
+	}
+}
+
+// ZipDeploy pushes a zip package to the function app's Kudu endpoint.
+func (c *armClient) ZipDeploy(siteName string, zipBytes []byte) error {
+	_, err := c.do(http.MethodPost,
+		fmt.Sprintf("https://%s.scm.azurewebsites.net/api/zipdeploy", siteName),
+		"application/zip", zipBytes, nil)
+	return err
+}
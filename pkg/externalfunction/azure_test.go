@@ -0,0 +1,292 @@
+package externalfunction
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeAzureClient serves Resource Manager requests from a fakeCloud.
+type fakeAzureClient struct {
+	*fakeCloud
+	token string
+	zips  map[string][]byte
+}
+
+func newFakeAzureClient(token string) *fakeAzureClient {
+	return &fakeAzureClient{fakeCloud: newFakeCloud(), token: token, zips: map[string][]byte{}}
+}
+
+func (c *fakeAzureClient) send(method string, resourceID string, body interface{}, out interface{}) error {
+	status, err := c.do(method, resourceID, body, out)
+	if status != 0 {
+		return fmt.Errorf("%s %s returned %d", method, resourceID, status)
+	}
+	return err
+}
+
+func (c *fakeAzureClient) Put(resourceID string, apiVersion string, body interface{}, out interface{}) error {
+	return c.send("PUT", resourceID, body, out)
+}
+
+func (c *fakeAzureClient) Post(resourceID string, apiVersion string, body interface{}, out interface{}) error {
+	return c.send("POST", resourceID, body, out)
+}
+
+func (c *fakeAzureClient) Get(resourceID string, apiVersion string, out interface{}) error {
+	return c.send("GET", resourceID, nil, out)
+}
+
+func (c *fakeAzureClient) Delete(resourceID string, apiVersion string) error {
+	return c.send("DELETE", resourceID, nil, nil)
+}
+
+func (c *fakeAzureClient) ZipDeploy(siteName string, zipBytes []byte) error {
+	c.writes++
+	c.zips[siteName] = zipBytes
+	return nil
+}
+
+const (
+	testAzureRG     = "/subscriptions/sub-1/resourceGroups/rg-1"
+	testAzureSite   = testAzureRG + "/providers/Microsoft.Web/sites/echo-fn-func"
+	testAzureAPIM   = testAzureRG + "/providers/Microsoft.ApiManagement/service/echo-fn-apim"
+	testAzureAPI    = testAzureAPIM + "/apis/echo_fn-api"
+	testAzureKey    = testAzureAPIM + "/namedValues/echo-fn-func-key"
+	testAzureStore  = testAzureRG + "/providers/Microsoft.Storage/storageAccounts/echofnsa"
+	testAzurePlanID = testAzureRG + "/providers/Microsoft.Web/serverfarms/echo_fn-plan"
+)
+
+// plannedAzure is an Azure provider planned with the defaults and a fake
+// client, creating its own API Management instance.
+func plannedAzure(t *testing.T) (*AzureConfig, *fakeAzureClient) {
+	t.Helper()
+	var client *fakeAzureClient
+	saved := newAzureClient
+	newAzureClient = func(token string) azureClient {
+		client = newFakeAzureClient(token)
+		return client
+	}
+	defer func() { newAzureClient = saved }()
+
+	cfg := NewAzureProvider(answering(t, map[string]string{
+		azureUseEnvQuestion:          "No",
+		"AZURE_ACCESS_TOKEN":         "token-1",
+		"AZURE_SUBSCRIPTION_ID":      "sub-1",
+		"AZURE_TENANT_ID":            "tenant-1",
+		azureResourceGroupQuestion:   "rg-1",
+		azureADApplicationQuestion:   "api-app-1",
+		azureExistingAPIMQuestion:    "No",
+		azurePublisherEmailQuestion:  "ops@example.com",
+		azureDefaultFunctionQuestion: "Yes",
+	})).(*AzureConfig)
+	if err := cfg.Plan("echo_fn", "echo_fn(n int)"); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, client
+}
+
+func TestAzurePlan(t *testing.T) {
+	cfg, client := plannedAzure(t)
+	if client == nil || client.token != "token-1" {
+		t.Fatalf("Plan did not connect with the access token")
+	}
+	if cfg.subscriptionID != "sub-1" || cfg.tenantID != "tenant-1" || cfg.resourceGroup != "rg-1" ||
+		cfg.location != "eastus" || cfg.adApplicationID != "api-app-1" {
+		t.Errorf("Plan gathered %+v", cfg)
+	}
+	want := AzureResources{
+		storageAccountName: "echofnsa",
+		planName:           "echo_fn-plan",
+		functionAppName:    "echo-fn-func",
+		functionName:       "echo_fn",
+		apimName:           "echo-fn-apim",
+		apimPublisherEmail: "ops@example.com",
+		apimCreate:         true,
+		apiName:            "echo_fn-api",
+		apiPath:            "echo_fn",
+	}
+	got := *cfg.Resources
+	got.functionZipBytes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan named\n%+v\nwant\n%+v", got, want)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(cfg.Resources.functionZipBytes), int64(len(cfg.Resources.functionZipBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, f := range r.File {
+		files = append(files, f.Name)
+	}
+	sort.Strings(files)
+	if want := []string{"function_app.py", "host.json", "requirements.txt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("default function zip has %v, want %v", files, want)
+	}
+}
+
+// apiPolicy is the validate-jwt policy of the API.
+func (c *fakeAzureClient) apiPolicy(t *testing.T) string {
+	t.Helper()
+	policy := c.resource(t, testAzureAPI+"/policies/policy")
+	return policy["properties"].(map[string]interface{})["value"].(string)
+}
+
+func provisionedAzure(t *testing.T) (*AzureConfig, *fakeAzureClient) {
+	t.Helper()
+	cfg, client := plannedAzure(t)
+	client.responses["POST "+testAzureStore+"/listKeys"] = `{"keys": [{"value": "storage-key"}]}`
+	client.responses["POST "+testAzureSite+"/host/default/listkeys"] = `{"functionKeys": {"default": "function-key"}}`
+	client.responses["GET "+testAzureAPIM] = `{"properties": {"gatewayUrl": "https://echo-fn-apim.azure-api.net"}}`
+	if err := cfg.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, client
+}
+
+func TestAzureProvision(t *testing.T) {
+	cfg, client := provisionedAzure(t)
+
+	var created []string
+	for url := range client.resources {
+		created = append(created, url)
+	}
+	sort.Strings(created)
+	want := []string{
+		testAzureAPIM,
+		testAzureAPI,
+		testAzureAPI + "/operations/post",
+		testAzureAPI + "/policies/policy",
+		testAzureKey,
+		testAzureStore,
+		testAzureSite,
+		testAzurePlanID,
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("Provision created\n%s\nwant\n%s", strings.Join(created, "\n"), strings.Join(want, "\n"))
+	}
+	if !bytes.Equal(client.zips["echo-fn-func"], cfg.Resources.functionZipBytes) {
+		t.Errorf("Provision did not deploy the planned zip")
+	}
+	if got := cfg.Endpoint(); got != "https://echo-fn-apim.azure-api.net/echo_fn" {
+		t.Errorf("Endpoint() = %q", got)
+	}
+
+	if site := client.resources[testAzureSite]; !strings.Contains(site, "AccountName=echofnsa;AccountKey=storage-key;") {
+		t.Errorf("function app does not use the storage account: %s", site)
+	}
+	api := client.resource(t, testAzureAPI)["properties"].(map[string]interface{})
+	if api["serviceUrl"] != "https://echo-fn-func.azurewebsites.net/api/echo_fn" {
+		t.Errorf("API is served by %v", api["serviceUrl"])
+	}
+	key := client.resource(t, testAzureKey)["properties"].(map[string]interface{})
+	if key["secret"] != true || key["value"] != "function-key" {
+		t.Errorf("function key is not a secret named value: %v", key)
+	}
+
+	policy := client.apiPolicy(t)
+	for _, want := range []string{
+		"https://login.microsoftonline.com/tenant-1/.well-known/openid-configuration",
+		"<audience>api-app-1</audience>",
+		"<audience>api://api-app-1</audience>",
+		"<value>{{echo-fn-func-key}}</value>",
+	} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("API policy is missing %s:\n%s", want, policy)
+		}
+	}
+	if strings.Contains(policy, "function-key") {
+		t.Errorf("API policy holds the function key in plain text:\n%s", policy)
+	}
+	// Until consent is granted Snowflake's app is unknown
+	if strings.Contains(policy, "required-claims") {
+		t.Errorf("API policy requires a claim before consent:\n%s", policy)
+	}
+}
+
+func TestAzureIntegrationSQL(t *testing.T) {
+	cfg, _ := provisionedAzure(t)
+	want := `create api integration if not exists echo_fn_api_integration
+	api_provider = azure_api_management
+	azure_tenant_id = 'tenant-1'
+	azure_ad_application_id = 'api-app-1'
+	api_allowed_prefixes = ('https://echo-fn-apim.azure-api.net/echo_fn')
+	enabled = true;`
+	if got := cfg.IntegrationSQL("echo_fn_api_integration"); got != want {
+		t.Errorf("IntegrationSQL() =\n%s\nwant\n%s", got, want)
+	}
+	want = `alter api integration echo_fn_api_integration set
+	azure_ad_application_id = 'api-app-1'
+	api_allowed_prefixes = ('https://echo-fn-apim.azure-api.net/echo_fn')
+	enabled = true;`
+	if got := cfg.IntegrationUpdateSQL("echo_fn_api_integration"); got != want {
+		t.Errorf("IntegrationUpdateSQL() =\n%s\nwant\n%s", got, want)
+	}
+	if _, ok := Provider(cfg).(Truster); ok {
+		t.Errorf("Azure is trusted by consent, not by an external id")
+	}
+}
+
+func TestAzureApplyConsent(t *testing.T) {
+	consentURL := "https://login.microsoftonline.com/tenant-1/oauth2/authorize?client_id=sf"
+
+	t.Run("consent granted", func(t *testing.T) {
+		cfg, client := provisionedAzure(t)
+		cfg.prompt = answering(t, map[string]string{
+			azureConsentQuestion: "Yes",
+			fmt.Sprintf(azureSnowflakeAppQuestion, "SnowflakeApp_123"): "snowflake-app-1",
+		})
+		if err := cfg.ApplyConsent(consentURL, "SnowflakeApp_123"); err != nil {
+			t.Fatal(err)
+		}
+		policy := client.apiPolicy(t)
+		if !strings.Contains(policy, `<claim name="appid">`) || !strings.Contains(policy, "<value>snowflake-app-1</value>") {
+			t.Errorf("API policy does not require Snowflake's app:\n%s", policy)
+		}
+		if !strings.Contains(policy, "<value>{{echo-fn-func-key}}</value>") {
+			t.Errorf("API policy lost the function key:\n%s", policy)
+		}
+	})
+
+	t.Run("consent declined", func(t *testing.T) {
+		cfg, client := provisionedAzure(t)
+		client.writes = 0
+		cfg.prompt = answering(t, map[string]string{azureConsentQuestion: "No"})
+		if err := cfg.ApplyConsent(consentURL, "SnowflakeApp_123"); err == nil {
+			t.Error("ApplyConsent succeeded without consent")
+		}
+		if client.writes > 0 {
+			t.Errorf("ApplyConsent changed the API without consent")
+		}
+	})
+}
+
+func TestAzureDestroy(t *testing.T) {
+	cfg, client := provisionedAzure(t)
+	if err := cfg.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.resources) > 0 {
+		t.Errorf("Destroy left %v", client.resources)
+	}
+
+	// An existing API Management instance is left alone
+	cfg, client = provisionedAzure(t)
+	cfg.Resources.apimCreate = false
+	if err := cfg.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for url := range client.resources {
+		left = append(left, url)
+	}
+	if want := []string{testAzureAPIM}; !reflect.DeepEqual(left, want) {
+		t.Errorf("Destroy left %v, want %v", left, want)
+	}
+}
@@ -1,75 +1,609 @@
 package externalfunction
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
-	"github.com/manifoldco/promptui"
 	"github.com/tampajohn/goflake/pkg/common"
 )
 
+// Version is recorded on the resources goflake creates; release builds set it
+// with -ldflags "-X github.com/tampajohn/goflake/pkg/externalfunction.Version=...".
+var Version = "0.1.0-beta"
+
 var (
 	wscol = 30
 	wsRow = 30
 )
 
-type provider int
+// Provider provisions the cloud side of an external function. Snowflake only
+// talks to a cloud through this interface, so additional clouds (or fakes)
+// just need to be registered with RegisterProvider.
+type Provider interface {
+	// Plan gathers credentials and the names of every resource to create.
+	Plan(extFuncName string, extFuncSignature string) error
+	// Provision creates (or reconfigures) the function and the proxy in front of it.
+	Provision() error
+	// Endpoint is the URL of the proxy the external function will call.
+	Endpoint() string
+	// IntegrationSQL is the statement creating the named api integration if
+	// it does not exist yet. Recreating an integration changes the identity
+	// Snowflake calls the proxy as, so it is never replaced.
+	IntegrationSQL(integration string) string
+	// IntegrationUpdateSQL is the `alter api integration` statement bringing
+	// an existing integration's settings up to date.
+	IntegrationUpdateSQL(integration string) string
+	// Destroy deletes the resources Provision created.
+	Destroy() error
+}
 
-const (
-	AWS provider = iota
+// Truster is implemented by providers that restrict the proxy to the
+// identity Snowflake calls it as, presenting an external id.
+type Truster interface {
+	// TrustProperties names the `describe integration` properties holding the
+	// external id and the identity Snowflake calls the proxy as.
+	TrustProperties() (externalID string, iamUser string)
+	// ApplyTrust restricts the proxy to the identity Snowflake calls it as.
+	ApplyTrust(externalID string, iamUser string) error
+}
+
+// IdentityTruster is implemented by providers that restrict the proxy to the
+// identity Snowflake calls it as, which presents no external id.
+type IdentityTruster interface {
+	// IdentityProperty names the `describe integration` property holding
+	// that identity.
+	IdentityProperty() string
+	// TrustIdentity restricts the proxy to identity.
+	TrustIdentity(identity string) error
+}
+
+// ConsentTruster is implemented by providers that Snowflake calls through its
+// multi-tenant app, which a tenant admin has to consent to first.
+type ConsentTruster interface {
+	// ApplyConsent walks the user through consenting at consentURL and
+	// restricts the proxy to the app.
+	ApplyConsent(consentURL string, multiTenantAppName string) error
+}
+
+// TrustRevoker is implemented by providers whose proxy can trust several
+// Snowflake accounts at once, so that one of them can be detached without
+// disturbing the others.
+type TrustRevoker interface {
+	Truster
+	// RevokeTrust stops trusting the identity ApplyTrust was given.
+	RevokeTrust(externalID string, iamUser string) error
+}
+
+// TrustRepairer is implemented by providers whose trust is tied to an
+// identity Snowflake regenerates whenever the integration is recreated.
+type TrustRepairer interface {
+	Truster
+	// RepairTrust trusts the identity again if the proxy has drifted from
+	// it, reporting whether it had.
+	RepairTrust(externalID string, iamUser string) (bool, error)
+}
+
+// Inventory is implemented by providers that tag the resources they create
+// and can find them again without knowing their names.
+type Inventory interface {
+	// Connect gathers just the credentials needed to look resources up.
+	Connect() error
+	// Inventory returns the identifiers of goflake's resources, keyed by the
+	// external function they belong to.
+	Inventory() (map[string][]string, error)
+}
+
+// Resolver is implemented by providers that can find the resources of an
+// existing function from its name, for commands that only operate on them.
+type Resolver interface {
+	// Resolve gathers just the credentials needed and looks the resources
+	// of extFuncName up.
+	Resolve(extFuncName string, extFuncSignature string) error
+}
+
+// resolve prepares p to operate on an existing function, falling back to the
+// full questionnaire for providers that cannot look its resources up.
+func resolve(p Provider, extFuncName string, extFuncSignature string) error {
+	if r, ok := p.(Resolver); ok {
+		return r.Resolve(extFuncName, extFuncSignature)
+	}
+	return p.Plan(extFuncName, extFuncSignature)
+}
+
+// KeyRotator is implemented by providers that can require Snowflake to
+// present an API key.
+type KeyRotator interface {
+	// NewAPIKey creates a key that works next to the current ones and
+	// returns its value.
+	NewAPIKey() (string, error)
+	// RetireAPIKeys deletes every key but the newest.
+	RetireAPIKeys() error
+}
+
+// Preflighter is implemented by providers that can check the caller's
+// permissions before anything is created.
+type Preflighter interface {
+	Preflight() []Check
+}
+
+// Check is the outcome of one preflight check; it passed unless Err is set.
+type Check struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// printChecks prints checks as a table and reports whether they all passed.
+func printChecks(checks []Check) bool {
+	passed := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	for _, c := range checks {
+		result, detail := "PASS", c.Detail
+		if c.Err != nil {
+			result, detail = "FAIL", c.Err.Error()
+			passed = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, result, detail)
+	}
+	w.Flush()
+	return passed
+}
+
+// preflight runs the provider's and Snowflake's checks.
+func preflight(p Provider, scfg *SnowflakeConfig) bool {
+	var checks []Check
+	if r, ok := p.(Preflighter); ok {
+		checks = append(checks, r.Preflight()...)
+	}
+	checks = append(checks, scfg.Preflight()...)
+	return printChecks(checks)
+}
+
+// Invoker is implemented by providers whose proxy can be called directly,
+// the way Snowflake calls it.
+type Invoker interface {
+	// Invoke posts body, a batch in Snowflake's JSON format, to the proxy.
+	// With trustCaller the proxy's identity may be made to trust the caller
+	// for the duration, when it does not already.
+	Invoke(body []byte, batchID string, trustCaller bool) (*InvokeResult, error)
+}
+
+// InvokeResult is the proxy's response to a direct invocation.
+type InvokeResult struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Duration   time.Duration
+}
+
+// LogReader is implemented by providers that can print the proxy's logs.
+type LogReader interface {
+	// Logs prints the log events of the last since, only those for the
+	// Snowflake batch batchID unless it is empty.
+	Logs(batchID string, since time.Duration) error
+}
+
+var (
+	providers     = map[string]func(common.Prompter) Provider{}
+	providerNames []string
+	overrides     EndpointOverrides
 )
 
-func (o provider) String() string {
-	supported := [...]string{"AWS"}
-	if int(o) > len(supported)-1 {
-		return common.NOTSUPPORTED
+// EndpointOverrides points goflake at something other than the real cloud and
+// Snowflake endpoints, e.g. LocalStack and a local Snowflake stand-in.
+type EndpointOverrides struct {
+	// AWSEndpointURL replaces the endpoint of every AWS service client.
+	AWSEndpointURL string
+	// SnowflakeHost replaces <account>.snowflakecomputing.com.
+	SnowflakeHost     string
+	SnowflakePort     int
+	SnowflakeProtocol string
+}
+
+// SetEndpointOverrides applies to every provider and Snowflake connection
+// created afterwards.
+func SetEndpointOverrides(o EndpointOverrides) {
+	overrides = o
+}
+
+func init() {
+	RegisterProvider("AWS", NewAWSProvider)
+	RegisterProvider("Azure", NewAzureProvider)
+	RegisterProvider("GCP", NewGCPProvider)
+}
+
+// RegisterProvider makes a provider selectable by name; registering an
+// existing name replaces its factory.
+func RegisterProvider(name string, factory func(prompt common.Prompter) Provider) {
+	if _, found := providers[name]; !found {
+		providerNames = append(providerNames, name)
 	}
-	return supported[o]
+	providers[name] = factory
+}
+
+// The questions every command starts with, named so that answers can be
+// scripted.
+const (
+	providerQuestion  = "What cloud provider would you like ?"
+	signatureQuestion = "What is the function's signature?"
+)
+
+func promptProvider(prompt common.Prompter) Provider {
+	_, selected := prompt.AskOptions(providerQuestion, providerNames)
+	return providers[selected](prompt)
 }
 
 func Start() {
-	prompt := promptui.Select{
-		Label: "What cloud provider would you like ?",
-		Items: []provider{AWS},
-	}
-	idx, _, err := prompt.Run()
-
-	if err != nil {
-		log.Fatalf("Prompt failed %v\n", err)
-		return
-	}
-	selected := provider(idx)
-	switch selected {
-	case AWS:
-		funcSig := common.PromptStringWithValidator(
-			"What is the function's signature?",
-			false,
-			"external_func(n int, v varchar)",
-			func(s string) error {
-				if len(s) == 0 || strings.Index(s, "(") < 1 || !strings.HasSuffix(s, ")") {
-					return fmt.Errorf("'%s' is not a valid function signature.", s)
-				}
-				return nil
-			})
-		funcSig = strings.TrimSpace(funcSig)
-		fn := strings.Split(funcSig, "(")[0]
-
-		cfg, err := NewAWSConfig(fn, funcSig)
-		if err != nil {
-			log.Fatalf("Error encountered: %s\n", err)
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := p.Plan(fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+	scfg := NewSnowflakeConfig(prompt)
+	if !preflight(p, scfg) && !prompt.AskYesNo("Some preflight checks failed. Would you like to continue anyway?") {
+		log.Fatalf("Preflight checks failed\n")
+	}
+
+	err = p.Provision()
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	err = scfg.CreateExternalFunction(p, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// Destroy deletes the cloud resources of an external function.
+func Destroy() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := p.Plan(fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+	err = p.Destroy()
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// Detach removes one Snowflake account's external function from a proxy that
+// other accounts keep using.
+func Detach() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	r, ok := p.(TrustRevoker)
+	if !ok {
+		log.Fatalf("This provider cannot detach a single Snowflake account, use Destroy instead\n")
+	}
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := p.Plan(fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	scfg := NewSnowflakeConfig(prompt)
+	err = scfg.DetachExternalFunction(r, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// RepairTrust re-aligns the proxy's trust with an integration that was
+// recreated outside of goflake.
+func RepairTrust() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	r, ok := p.(TrustRepairer)
+	if !ok {
+		log.Fatalf("This provider's trust does not depend on the integration's identity, there is nothing to repair\n")
+	}
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := resolve(p, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	scfg := NewSnowflakeConfig(prompt)
+	err = scfg.RepairTrust(r, fn)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// List prints the resources goflake created, grouped by external function.
+func List() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	inv, ok := p.(Inventory)
+	if !ok {
+		log.Fatalf("This provider cannot list the resources goflake created\n")
+	}
+	err := inv.Connect()
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+	resources, err := inv.Inventory()
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	var functions []string
+	for fn := range resources {
+		functions = append(functions, fn)
+	}
+	sort.Strings(functions)
+	for _, fn := range functions {
+		fmt.Println(fn)
+		ids := resources[fn]
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Printf("  %s\n", id)
+		}
+	}
+	if len(functions) == 0 {
+		fmt.Println("No resources tagged by goflake were found")
+	}
+}
+
+// Doctor checks that the AWS (or other cloud) and Snowflake credentials can
+// do everything creating the function takes, without creating anything. It
+// fails when any check does.
+func Doctor() error {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := p.Plan(fn, funcSig)
+	if err != nil {
+		return err
+	}
+	scfg := NewSnowflakeConfig(prompt)
+	if !preflight(p, scfg) {
+		return fmt.Errorf("preflight checks failed")
+	}
+	return nil
+}
+
+// RotateAPIKey replaces the API key Snowflake presents to the proxy.
+func RotateAPIKey() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	r, ok := p.(KeyRotator)
+	if !ok {
+		log.Fatalf("This provider does not use API keys\n")
+	}
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := resolve(p, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	scfg := NewSnowflakeConfig(prompt)
+	err = scfg.RotateAPIKey(r, fn)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// Logs prints a deployed function's recent logs, optionally only those for
+// one Snowflake batch (the batch id is in Snowflake's query history).
+func Logs() {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	r, ok := p.(LogReader)
+	if !ok {
+		log.Fatalf("This provider does not support reading logs\n")
+	}
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := resolve(p, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	batchID := prompt.PromptStringWithValidator("Which batch ID should the logs be filtered by? (leave empty for all)", false, "", func(s string) error {
+		return nil
+	})
+	batchID = strings.TrimSpace(batchID)
+	since := prompt.PromptStringWithValidator("How far back should logs be read?", false, "15m", func(s string) error {
+		_, err := time.ParseDuration(s)
+		return err
+	})
+	d, _ := time.ParseDuration(since)
+
+	err = r.Logs(batchID, d)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+}
+
+// Invoke calls a deployed function's proxy without Snowflake. args are the
+// values of a single row (parsed as JSON where possible) or "@file" naming a
+// batch in Snowflake's format; without args the row is prompted for.
+// trustCaller is passed on to the provider's Invoke.
+func Invoke(args []string, trustCaller bool) {
+	prompt := common.Terminal{}
+	p := promptProvider(prompt)
+	r, ok := p.(Invoker)
+	if !ok {
+		log.Fatalf("This provider does not support direct invocation\n")
+	}
+	fn, funcSig := promptFunctionSignature(prompt)
+
+	err := resolve(p, fn, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+
+	body, err := invokeBody(prompt, args, funcSig)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+	batchID := fmt.Sprintf("goflake-invoke-%d", time.Now().UnixNano())
+	fmt.Printf("POST batch %s:\n%s\n", batchID, body)
+
+	res, err := r.Invoke(body, batchID, trustCaller)
+	if err != nil {
+		log.Fatalf("Error encountered: %s\n", err)
+	}
+	fmt.Printf("HTTP %d in %s\n", res.StatusCode, res.Duration.Round(time.Millisecond))
+	for _, h := range []string{"X-Amzn-Requestid", "X-Amzn-Errortype", "X-Amz-Apigw-Id"} {
+		if v := res.Header.Get(h); v != "" {
+			fmt.Printf("%s: %s\n", h, v)
 		}
-		err = cfg.ConfigureAwsRoles()
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, res.Body, "", "  ") == nil {
+		fmt.Println(pretty.String())
+	} else {
+		fmt.Println(string(res.Body))
+	}
+}
+
+// invokeBody builds the batch Invoke sends.
+func invokeBody(prompt common.Prompter, args []string, signature string) ([]byte, error) {
+	if len(args) == 1 && strings.HasPrefix(args[0], "@") {
+		data, err := ioutil.ReadFile(args[0][1:])
 		if err != nil {
-			log.Fatalf("Error encountered: %s\n", err)
+			return nil, err
+		}
+		var batch struct {
+			Data [][]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(data, &batch); err != nil || batch.Data == nil {
+			return nil, fmt.Errorf("%s is not a batch like {\"data\": [[0, ...]]}", args[0][1:])
 		}
+		return data, nil
+	}
 
-		scfg := NewSnowflakeConfig(cfg)
-		err = scfg.AddTrustToAWSRole()
+	row := []interface{}{0}
+	if len(args) > 0 {
+		for _, arg := range args {
+			var v interface{}
+			if json.Unmarshal([]byte(arg), &v) != nil {
+				v = arg
+			}
+			row = append(row, v)
+		}
+	} else {
+		var sample []interface{}
+		for _, t := range signatureTypes(signature) {
+			sample = append(sample, sampleJSONValue(t))
+		}
+		def, _ := json.Marshal(sample)
+		values := prompt.PromptStringWithValidator("What values should be sent (a JSON array)?", false, string(def), func(s string) error {
+			var v []interface{}
+			return json.Unmarshal([]byte(s), &v)
+		})
+		var v []interface{}
+		_ = json.Unmarshal([]byte(values), &v)
+		row = append(row, v...)
+	}
+	return json.Marshal(map[string]interface{}{"data": [][]interface{}{row}})
+}
+
+func promptFunctionSignature(prompt common.Prompter) (name string, signature string) {
+	signature = prompt.PromptStringWithValidator(
+		signatureQuestion,
+		false,
+		"external_func(n int, v varchar)",
+		func(s string) error {
+			if len(s) == 0 || strings.Index(s, "(") < 1 || !strings.HasSuffix(s, ")") {
+				return fmt.Errorf("'%s' is not a valid function signature.", s)
+			}
+			return nil
+		})
+	signature = strings.TrimSpace(signature)
+	name = strings.Split(signature, "(")[0]
+	return name, signature
+}
+
+// signatureArgTypes turns "f(n int, v varchar)" into "int, varchar", the form
+// `drop function` identifies a function by.
+func signatureArgTypes(signature string) string {
+	return strings.Join(signatureTypes(signature), ", ")
+}
+
+// signatureTypes returns the argument types of signature, keeping commas
+// inside a type such as number(38, 0).
+func signatureTypes(signature string) []string {
+	args := signature[strings.Index(signature, "(")+1 : strings.LastIndex(signature, ")")]
+	var types []string
+	depth, start := 0, 0
+	for i := 0; i <= len(args); i++ {
+		if i < len(args) && args[i] != ',' {
+			switch args[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			continue
+		}
+		if i < len(args) && depth > 0 {
+			continue
+		}
+		fields := strings.Fields(args[start:i])
+		if len(fields) > 1 {
+			types = append(types, strings.Join(fields[1:], " "))
+		}
+		start = i + 1
+	}
+	return types
+}
+
+// promptZipFile asks for the path of a deployment package and reads it.
+func promptZipFile(prompt common.Prompter) ([]byte, error) {
+	zipPath := prompt.PromptStringWithValidator("What is the path of the zip file you'd like to use?", false, "", func(p string) error {
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("This is a directory, not a file")
+		}
+		return nil
+	})
+	return ioutil.ReadFile(zipPath)
+}
+
+// zipSource packages the given file name/contents pairs into a zip archive.
+func zipSource(files map[string]string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for name, contents := range files {
+		f, err := w.Create(name)
 		if err != nil {
-			log.Fatalf("Error encountered: %s\n", err)
+			return nil, err
 		}
-	default:
-		log.Fatalf("%s is not supported at this time.\n", selected)
+		if _, err = f.Write([]byte(contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,295 @@
+package externalfunction
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tampajohn/goflake/pkg/common"
+)
+
+// scriptedPrompter answers questions from answers; other questions take their
+// default. An answer that is never asked fails the test.
+type scriptedPrompter struct {
+	t       *testing.T
+	answers map[string]string
+	asked   map[string]bool
+}
+
+func answering(t *testing.T, answers map[string]string) *scriptedPrompter {
+	t.Helper()
+	p := &scriptedPrompter{t: t, answers: answers, asked: map[string]bool{}}
+	t.Cleanup(func() {
+		for question := range p.answers {
+			if !p.asked[question] {
+				t.Errorf("%q was never asked", question)
+			}
+		}
+	})
+	return p
+}
+
+func (p *scriptedPrompter) answer(question string, defValue string, validator func(string) error) string {
+	p.t.Helper()
+	p.asked[question] = true
+	result, ok := p.answers[question]
+	if !ok || result == "" {
+		result = defValue
+	}
+	if validator == nil && result == "" {
+		p.t.Fatalf("no answer to %q", question)
+	}
+	if validator != nil {
+		if err := validator(result); err != nil {
+			p.t.Fatalf("answer to %q: %v", question, err)
+		}
+	}
+	return result
+}
+
+func (p *scriptedPrompter) AskYesNo(question string) bool {
+	return p.answer(question, "No", nil) == "Yes"
+}
+
+func (p *scriptedPrompter) AskOptions(question string, options []string) (int, string) {
+	result := p.answer(question, "", nil)
+	for i, o := range options {
+		if o == result {
+			return i, result
+		}
+	}
+	p.t.Fatalf("%q is not an option of %q", result, question)
+	return 0, ""
+}
+
+func (p *scriptedPrompter) EnvOrString(envVariable string, mask bool) string {
+	if value, isFound := os.LookupEnv(envVariable); isFound {
+		return value
+	}
+	return p.answer(envVariable, "", nil)
+}
+
+func (p *scriptedPrompter) PromptString(question string, mask bool, defValue string) string {
+	return p.answer(question, defValue, nil)
+}
+
+func (p *scriptedPrompter) PromptStringWithValidator(question string, mask bool, defValue string, validator func(string) error) string {
+	return p.answer(question, defValue, validator)
+}
+
+// fakeCloud is the REST API behind the fake Azure and GCP clients. It keeps
+// what is written to it, so tests can assert on the resulting resources
+// rather than on the requests made: PUT stores a resource, PATCH merges into
+// it, DELETE removes it with everything under it and GET answers from it, or
+// 404s. Query strings are not part of a resource's url.
+type fakeCloud struct {
+	// resources holds the JSON of every resource, by url
+	resources map[string]string
+	// responses holds the JSON answering a request, e.g. a POST action, or
+	// the fields the cloud adds to an existing resource when it is read
+	responses map[string]string
+	// statuses fails a request with a status
+	statuses map[string]int
+	// posted holds the last body POSTed to each url
+	posted map[string]interface{}
+	// writes counts the requests that were not GETs
+	writes int
+}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{
+		resources: map[string]string{},
+		responses: map[string]string{},
+		statuses:  map[string]int{},
+		posted:    map[string]interface{}{},
+	}
+}
+
+// do serves a request, returning the status it failed with, if any.
+func (c *fakeCloud) do(method string, url string, body interface{}, out interface{}) (int, error) {
+	url = strings.SplitN(url, "?", 2)[0]
+	call := method + " " + url
+	if status, found := c.statuses[call]; found {
+		return status, nil
+	}
+	if method != http.MethodGet {
+		c.writes++
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, exists := c.resources[url]
+	switch method {
+	case http.MethodPut:
+		c.resources[url] = string(data)
+	case http.MethodPatch:
+		if !exists {
+			return http.StatusNotFound, nil
+		}
+		c.resources[url] = mergeJSON(c.resources[url], string(data))
+	case http.MethodDelete:
+		if !exists {
+			return http.StatusNotFound, nil
+		}
+		for resource := range c.resources {
+			if resource == url || strings.HasPrefix(resource, url+"/") {
+				delete(c.resources, resource)
+			}
+		}
+	case http.MethodPost:
+		c.posted[url] = body
+	case http.MethodGet:
+		if !exists {
+			return http.StatusNotFound, nil
+		}
+	}
+
+	response := c.responses[call]
+	if method == http.MethodGet && exists {
+		response = mergeJSON(c.resources[url], response)
+	}
+	if out == nil || response == "" {
+		return 0, nil
+	}
+	return 0, json.Unmarshal([]byte(response), out)
+}
+
+// mergeJSON overlays the fields of patch onto those of doc.
+func mergeJSON(doc string, patch string) string {
+	var d, p map[string]interface{}
+	json.Unmarshal([]byte(doc), &d)
+	json.Unmarshal([]byte(patch), &p)
+	data, _ := json.Marshal(mergeFields(d, p))
+	return string(data)
+}
+
+func mergeFields(doc map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		if fields, ok := v.(map[string]interface{}); ok {
+			existing, _ := doc[k].(map[string]interface{})
+			v = mergeFields(existing, fields)
+		}
+		doc[k] = v
+	}
+	return doc
+}
+
+// resource decodes the resource at url, failing the test if there is none.
+func (c *fakeCloud) resource(t *testing.T, url string) map[string]interface{} {
+	t.Helper()
+	data, found := c.resources[url]
+	if !found {
+		t.Fatalf("%s does not exist", url)
+	}
+	var r map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// fakeProvider records the calls the Snowflake side makes.
+type fakeProvider struct {
+	calls []string
+}
+
+func (p *fakeProvider) record(call string) error {
+	p.calls = append(p.calls, call)
+	return nil
+}
+
+func (p *fakeProvider) Plan(extFuncName string, extFuncSignature string) error {
+	return p.record("Plan " + extFuncSignature)
+}
+func (p *fakeProvider) Provision() error                         { return p.record("Provision") }
+func (p *fakeProvider) Endpoint() string                         { return "https://fake.example.com/" }
+func (p *fakeProvider) IntegrationSQL(integration string) string { return "create " + integration }
+func (p *fakeProvider) IntegrationUpdateSQL(integration string) string {
+	return "alter " + integration
+}
+func (p *fakeProvider) TrustProperties() (string, string) { return "FAKE_EXTERNAL_ID", "FAKE_USER" }
+func (p *fakeProvider) ApplyTrust(externalID string, iamUser string) error {
+	return p.record("ApplyTrust " + externalID + " " + iamUser)
+}
+func (p *fakeProvider) Destroy() error { return p.record("Destroy") }
+
+// withProviders runs f against a copy of the registry.
+func withProviders(f func()) {
+	saved, savedNames := providers, providerNames
+	providers = map[string]func(common.Prompter) Provider{}
+	for name, factory := range saved {
+		providers[name] = factory
+	}
+	providerNames = append([]string(nil), savedNames...)
+	defer func() { providers, providerNames = saved, savedNames }()
+	f()
+}
+
+func TestRegisterProvider(t *testing.T) {
+	withProviders(func() {
+		if want := []string{"AWS", "Azure", "GCP"}; !reflect.DeepEqual(providerNames, want) {
+			t.Fatalf("providerNames = %v, want %v", providerNames, want)
+		}
+
+		first, second := &fakeProvider{}, &fakeProvider{}
+		RegisterProvider("Fake", func(common.Prompter) Provider { return first })
+		RegisterProvider("Fake", func(common.Prompter) Provider { return second })
+		if want := []string{"AWS", "Azure", "GCP", "Fake"}; !reflect.DeepEqual(providerNames, want) {
+			t.Errorf("re-registering listed the provider twice: %v", providerNames)
+		}
+		if providers["Fake"](common.Terminal{}) != second {
+			t.Errorf("re-registering did not replace the factory")
+		}
+	})
+}
+
+func TestPromptProvider(t *testing.T) {
+	withProviders(func() {
+		fake := &fakeProvider{}
+		RegisterProvider("Fake", func(common.Prompter) Provider { return fake })
+		prompt := answering(t, map[string]string{
+			providerQuestion:  "Fake",
+			signatureQuestion: "echo(n int, v varchar)",
+		})
+		p := promptProvider(prompt)
+		if p != fake {
+			t.Fatalf("promptProvider() = %T, want the registered fake", p)
+		}
+		name, signature := promptFunctionSignature(prompt)
+		if name != "echo" || signature != "echo(n int, v varchar)" {
+			t.Errorf("promptFunctionSignature() = %q, %q", name, signature)
+		}
+		p.Plan(name, signature)
+		if want := []string{"Plan echo(n int, v varchar)"}; !reflect.DeepEqual(fake.calls, want) {
+			t.Errorf("calls = %v, want %v", fake.calls, want)
+		}
+	})
+
+	for _, name := range []string{"AWS", "Azure", "GCP"} {
+		p := promptProvider(answering(t, map[string]string{providerQuestion: name}))
+		var ok bool
+		switch name {
+		case "AWS":
+			_, ok = p.(*AWSConfig)
+		case "Azure":
+			_, ok = p.(*AzureConfig)
+		case "GCP":
+			_, ok = p.(*GCPConfig)
+		}
+		if !ok {
+			t.Errorf("%s provider is a %T", name, p)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package externalfunction
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tampajohn/goflake/pkg/common"
+)
+
+const (
+	gcpFunctionsURL  = "https://cloudfunctions.googleapis.com/v1"
+	gcpAPIGatewayURL = "https://apigateway.googleapis.com/v1"
+
+	// GCPFunctionSource is the default Cloud Function that echoes its inputs
+	// back to Snowflake, mirroring the default lambda.
+	GCPFunctionSource = `import json
+
+
+def external_function(request):
+    rows_to_return = []
+    try:
+        rows = request.get_json()["data"]
+        for row in rows:
+            rows_to_return.append([row[0], ["Echoing inputs:"] + row[1:]])
+        return json.dumps({"data": rows_to_return}), 200
+    except Exception:
+        return request.get_data(), 400
+`
+
+	// GCPOpenAPISpec is the API Gateway config. Requests must carry a JWT
+	// issued by the given service account (Snowflake's, once known).
+	GCPOpenAPISpec = `swagger: '2.0'
+info:
+  title: %s
+  version: 1.0.0
+schemes:
+  - https
+produces:
+  - application/json
+paths:
+  /:
+    post:
+      summary: Snowflake external function
+      operationId: %s
+      x-google-backend:
+        address: %s
+        protocol: h2
+      responses:
+        '200':
+          description: OK
+      security:
+        - snowflakeAccess01: []
+securityDefinitions:
+  snowflakeAccess01:
+    authorizationUrl: ""
+    flow: implicit
+    type: oauth2
+    x-google-issuer: %s
+    x-google-jwks_uri: https://www.googleapis.com/robot/v1/metadata/x509/%s
+`
+)
+
+// gcpClient is the subset of the Cloud Functions and API Gateway REST APIs
+// used to provision external functions; it is satisfied by googleClient and
+// by fakes.
+type gcpClient interface {
+	// Do sends a JSON request to url, waits on any long running operation it
+	// starts and decodes the final response into out.
+	Do(method string, url string, body interface{}, out interface{}) error
+	Upload(uploadURL string, zipBytes []byte) error
+}
+
+// newGCPClient connects with an access token; tests replace it with a fake.
+var newGCPClient = func(token string) gcpClient {
+	return newGoogleClient(token)
+}
+
+type GCPConfig struct {
+	client           gcpClient
+	project          string
+	region           string
+	Resources        *GCPResources
+	extFuncName      string
+	extFuncSignature string
+	prompt           common.Prompter
+}
+
+type GCPResources struct {
+	functionName          string
+	functionRuntime       string
+	functionEntryPoint    string
+	functionURL           string
+	functionZipBytes      []byte
+	apiName               string
+	apiManagedService     string
+	apiConfigName         string
+	gatewayName           string
+	gatewayServiceAccount string
+	gatewayEndpoint       string
+	snowflakeAccount      string
+}
+
+// NewGCPProvider returns an unplanned Google Cloud provider.
+func NewGCPProvider(prompt common.Prompter) Provider {
+	return &GCPConfig{prompt: prompt, Resources: &GCPResources{}}
+}
+
+// The questions Plan asks, named so that answers can be scripted.
+const (
+	gcpUseEnvQuestion          = "Would you like to us to attempt to use your GCP_[ACCESS_TOKEN|PROJECT|REGION] from your environment?"
+	gcpFunctionNameQuestion    = "What would you like the cloud function to be named?"
+	gcpRuntimeQuestion         = "What cloud function runtime would you like to use?"
+	gcpAPINameQuestion         = "What would you like the api to be named?"
+	gcpGatewayNameQuestion     = "What would you like the api gateway to be named?"
+	gcpServiceAccountQuestion  = "What service account should the gateway use to invoke the function?"
+	gcpDefaultFunctionQuestion = "Would you like to use the default cloud function?"
+	gcpEntryPointQuestion      = "What is the entry point of your cloud function?"
+)
+
+// Plan gathers credentials and the names of the cloud function, api and
+// gateway.
+func (cfg *GCPConfig) Plan(extFuncName string, extFuncSignature string) error {
+	cfg.extFuncName = extFuncName
+	cfg.extFuncSignature = extFuncSignature
+
+	var token string
+	if cfg.prompt.AskYesNo(gcpUseEnvQuestion) {
+		// Attempt to get the gcp creds from ENV; fail back to prompting the user
+		token = cfg.prompt.EnvOrString("GCP_ACCESS_TOKEN", true)
+		cfg.project = cfg.prompt.EnvOrString("GCP_PROJECT", false)
+		cfg.region = cfg.prompt.EnvOrString("GCP_REGION", false)
+	} else {
+		// Just get the creds from the user (gcloud auth print-access-token)
+		token = cfg.prompt.PromptString("GCP_ACCESS_TOKEN", true, "")
+		cfg.project = cfg.prompt.PromptString("GCP_PROJECT", false, "")
+		cfg.region = cfg.prompt.PromptString("GCP_REGION", false, "us-central1")
+	}
+	cfg.client = newGCPClient(token)
+
+	// API Gateway ids are lowercase letters, digits and hyphens
+	id := strings.ToLower(strings.Replace(extFuncName, "_", "-", -1))
+	cfg.Resources.functionName = cfg.prompt.PromptString(
+		gcpFunctionNameQuestion,
+		false,
+		id+"-function")
+	cfg.Resources.functionRuntime = cfg.prompt.PromptString(
+		gcpRuntimeQuestion,
+		false,
+		"python310")
+	cfg.Resources.apiName = cfg.prompt.PromptString(
+		gcpAPINameQuestion,
+		false,
+		id+"-api")
+	cfg.Resources.gatewayName = cfg.prompt.PromptString(
+		gcpGatewayNameQuestion,
+		false,
+		id+"-gateway")
+	cfg.Resources.gatewayServiceAccount = cfg.prompt.PromptString(
+		gcpServiceAccountQuestion,
+		false,
+		"")
+
+	if cfg.prompt.AskYesNo(gcpDefaultFunctionQuestion) {
+		cfg.Resources.functionEntryPoint = "external_function"
+		functionData, err := zipSource(map[string]string{
+			"main.py":          GCPFunctionSource,
+			"requirements.txt": "",
+		})
+		if err != nil {
+			return err
+		}
+		cfg.Resources.functionZipBytes = functionData
+	} else {
+		data, err := promptZipFile(cfg.prompt)
+		if err != nil {
+			return err
+		}
+		cfg.Resources.functionEntryPoint = cfg.prompt.PromptString(gcpEntryPointQuestion, false, "external_function")
+		cfg.Resources.functionZipBytes = data
+	}
+
+	return nil
+}
+
+func (cfg *GCPConfig) functionParent() string {
+	return fmt.Sprintf("projects/%s/locations/%s", cfg.project, cfg.region)
+}
+
+func (cfg *GCPConfig) apiPath() string {
+	return fmt.Sprintf("projects/%s/locations/global/apis/%s", cfg.project, cfg.Resources.apiName)
+}
+
+func (cfg *GCPConfig) gatewayPath() string {
+	return fmt.Sprintf("projects/%s/locations/%s/gateways/%s", cfg.project, cfg.region, cfg.Resources.gatewayName)
+}
+
+func (cfg *GCPConfig) CreateOrConfigureCloudFunction() error {
+	var upload struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	err := cfg.client.Do(http.MethodPost,
+		fmt.Sprintf("%s/%s/functions:generateUploadUrl", gcpFunctionsURL, cfg.functionParent()),
+		map[string]string{}, &upload)
+	if err != nil {
+		return err
+	}
+	err = cfg.client.Upload(upload.UploadURL, cfg.Resources.functionZipBytes)
+	if err != nil {
+		return err
+	}
+
+	name := cfg.functionParent() + "/functions/" + cfg.Resources.functionName
+	function := map[string]interface{}{
+		"name":            name,
+		"runtime":         cfg.Resources.functionRuntime,
+		"entryPoint":      cfg.Resources.functionEntryPoint,
+		"sourceUploadUrl": upload.UploadURL,
+		"httpsTrigger":    map[string]string{"securityLevel": "SECURE_ALWAYS"},
+	}
+
+	var existing struct {
+		Name string `json:"name"`
+	}
+	found, err := cfg.getIfExists(fmt.Sprintf("%s/%s", gcpFunctionsURL, name), &existing)
+	if err != nil {
+		return err
+	}
+	if found {
+		// Will redeploy the source of an existing function
+		err = cfg.client.Do(http.MethodPatch,
+			fmt.Sprintf("%s/%s?updateMask=runtime,entryPoint,sourceUploadUrl", gcpFunctionsURL, name),
+			function, nil)
+	} else {
+		err = cfg.client.Do(http.MethodPost,
+			fmt.Sprintf("%s/%s/functions", gcpFunctionsURL, cfg.functionParent()),
+			function, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	var f struct {
+		HTTPSTrigger struct {
+			URL string `json:"url"`
+		} `json:"httpsTrigger"`
+	}
+	err = cfg.client.Do(http.MethodGet, fmt.Sprintf("%s/%s", gcpFunctionsURL, name), nil, &f)
+	if err != nil {
+		return err
+	}
+	cfg.Resources.functionURL = f.HTTPSTrigger.URL
+
+	// Only the gateway's service account may invoke the function
+	return cfg.client.Do(http.MethodPost,
+		fmt.Sprintf("%s/%s:setIamPolicy", gcpFunctionsURL, name),
+		map[string]interface{}{
+			"policy": map[string]interface{}{
+				"bindings": []map[string]interface{}{
+					{
+						"role":    "roles/cloudfunctions.invoker",
+						"members": []string{"serviceAccount:" + cfg.Resources.gatewayServiceAccount},
+					},
+				},
+			},
+		}, nil)
+}
+
+func (cfg *GCPConfig) CreateAPIGateway() error {
+	var api struct {
+		ManagedService string `json:"managedService"`
+	}
+	found, err := cfg.getIfExists(fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.apiPath()), &api)
+	if err != nil {
+		return err
+	}
+	if !found {
+		err = cfg.client.Do(http.MethodPost,
+			fmt.Sprintf("%s/projects/%s/locations/global/apis?apiId=%s", gcpAPIGatewayURL, cfg.project, cfg.Resources.apiName),
+			map[string]string{"displayName": cfg.Resources.apiName}, nil)
+		if err != nil {
+			return err
+		}
+		err = cfg.client.Do(http.MethodGet, fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.apiPath()), nil, &api)
+		if err != nil {
+			return err
+		}
+	}
+	cfg.Resources.apiManagedService = api.ManagedService
+
+	// Until Snowflake's service account is known only the gateway's own
+	// service account can obtain a token the gateway will accept.
+	err = cfg.CreateAPIConfig(cfg.Resources.gatewayServiceAccount)
+	if err != nil {
+		return err
+	}
+
+	var gw struct {
+		DefaultHostname string `json:"defaultHostname"`
+	}
+	found, err = cfg.getIfExists(fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.gatewayPath()), &gw)
+	if err != nil {
+		return err
+	}
+	if !found {
+		err = cfg.client.Do(http.MethodPost,
+			fmt.Sprintf("%s/projects/%s/locations/%s/gateways?gatewayId=%s", gcpAPIGatewayURL, cfg.project, cfg.region, cfg.Resources.gatewayName),
+			map[string]string{"apiConfig": cfg.Resources.apiConfigName}, nil)
+		if err != nil {
+			return err
+		}
+		err = cfg.client.Do(http.MethodGet, fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.gatewayPath()), nil, &gw)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = cfg.UpdateGatewayConfig()
+		if err != nil {
+			return err
+		}
+	}
+	cfg.Resources.gatewayEndpoint = fmt.Sprintf("https://%s/", gw.DefaultHostname)
+	return nil
+}
+
+// CreateAPIConfig uploads a new, immutable api config whose security
+// definition trusts tokens issued by issuerServiceAccount.
+func (cfg *GCPConfig) CreateAPIConfig(issuerServiceAccount string) error {
+	configID := fmt.Sprintf("%s-%d", cfg.Resources.apiName, time.Now().Unix())
+	openAPISpec := fmt.Sprintf(GCPOpenAPISpec,
+		cfg.Resources.apiName,
+		strings.Replace(cfg.extFuncName, "-", "_", -1),
+		cfg.Resources.functionURL,
+		issuerServiceAccount,
+		issuerServiceAccount)
+
+	err := cfg.client.Do(http.MethodPost,
+		fmt.Sprintf("%s/%s/configs?apiConfigId=%s", gcpAPIGatewayURL, cfg.apiPath(), configID),
+		map[string]interface{}{
+			"gatewayServiceAccount": cfg.Resources.gatewayServiceAccount,
+			"openapiDocuments": []map[string]interface{}{
+				{
+					"document": map[string]string{
+						"path":     "spec.yaml",
+						"contents": base64.StdEncoding.EncodeToString([]byte(openAPISpec)),
+					},
+				},
+			},
+		}, nil)
+	if err != nil {
+		return err
+	}
+	cfg.Resources.apiConfigName = cfg.apiPath() + "/configs/" + configID
+	return nil
+}
+
+// getIfExists decodes the resource at url into out, reporting false instead of
+// an error when it does not exist.
+func (cfg *GCPConfig) getIfExists(url string, out interface{}) (bool, error) {
+	err := cfg.client.Do(http.MethodGet, url, nil, out)
+	if isGoogleNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cfg *GCPConfig) UpdateGatewayConfig() error {
+	return cfg.client.Do(http.MethodPatch,
+		fmt.Sprintf("%s/%s?updateMask=apiConfig", gcpAPIGatewayURL, cfg.gatewayPath()),
+		map[string]string{"apiConfig": cfg.Resources.apiConfigName}, nil)
+}
+
+// Provision deploys the cloud function and the api gateway in front of it.
+func (cfg *GCPConfig) Provision() error {
+	err := cfg.CreateOrConfigureCloudFunction()
+	if err != nil {
+		return err
+	}
+	return cfg.CreateAPIGateway()
+}
+
+func (cfg *GCPConfig) Endpoint() string {
+	return cfg.Resources.gatewayEndpoint
+}
+
+func (cfg *GCPConfig) IntegrationSQL(integration string) string {
+	return fmt.Sprintf(`create api integration if not exists %s
+	api_provider = google_api_gateway
+	google_audience = '%s'
+	api_allowed_prefixes = ('%s')
+	enabled = true;`,
+		integration,
+		cfg.Resources.apiManagedService,
+		cfg.Resources.gatewayEndpoint)
+}
+
+func (cfg *GCPConfig) IntegrationUpdateSQL(integration string) string {
+	return fmt.Sprintf(`alter api integration %s set
+	api_allowed_prefixes = ('%s')
+	enabled = true;`,
+		integration,
+		cfg.Resources.gatewayEndpoint)
+}
+
+// IdentityProperty names the integration's service account; Snowflake
+// presents no external id to GCP.
+func (cfg *GCPConfig) IdentityProperty() string {
+	return "API_GCP_SERVICE_ACCOUNT"
+}
+
+// TrustIdentity re-configures the gateway to only accept tokens issued by the
+// integration's service account.
+func (cfg *GCPConfig) TrustIdentity(serviceAccount string) error {
+	cfg.Resources.snowflakeAccount = serviceAccount
+	if cfg.Resources.snowflakeAccount == "" {
+		return fmt.Errorf("the integration did not report an API_GCP_SERVICE_ACCOUNT")
+	}
+
+	err := cfg.CreateAPIConfig(cfg.Resources.snowflakeAccount)
+	if err != nil {
+		return err
+	}
+	return cfg.UpdateGatewayConfig()
+}
+
+// Destroy deletes the gateway, the api with all of its configs and the cloud
+// function.
+func (cfg *GCPConfig) Destroy() error {
+	fmt.Printf("Deleting gateway %s\n", cfg.Resources.gatewayName)
+	err := cfg.client.Do(http.MethodDelete, fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.gatewayPath()), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	var configs struct {
+		APIConfigs []struct {
+			Name string `json:"name"`
+		} `json:"apiConfigs"`
+	}
+	err = cfg.client.Do(http.MethodGet, fmt.Sprintf("%s/%s/configs", gcpAPIGatewayURL, cfg.apiPath()), nil, &configs)
+	if err != nil {
+		return err
+	}
+	for _, c := range configs.APIConfigs {
+		fmt.Printf("Deleting api config %s\n", c.Name)
+		err = cfg.client.Do(http.MethodDelete, fmt.Sprintf("%s/%s", gcpAPIGatewayURL, c.Name), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Deleting api %s\n", cfg.Resources.apiName)
+	err = cfg.client.Do(http.MethodDelete, fmt.Sprintf("%s/%s", gcpAPIGatewayURL, cfg.apiPath()), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleting cloud function %s\n", cfg.Resources.functionName)
+	return cfg.client.Do(http.MethodDelete,
+		fmt.Sprintf("%s/%s/functions/%s", gcpFunctionsURL, cfg.functionParent(), cfg.Resources.functionName), nil, nil)
+}
+
+// googleClient talks to Google Cloud REST APIs with an OAuth access token,
+// e.g. the output of `gcloud auth print-access-token`.
+type googleClient struct {
+	token      string
+	httpClient *http.Client
+	pollEvery  time.Duration
+	pollFor    time.Duration
+}
+
+func newGoogleClient(token string) *googleClient {
+	return &googleClient{
+		token:      token,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		pollEvery:  10 * time.Second,
+		pollFor:    30 * time.Minute,
+	}
+}
+
+func (c *googleClient) send(method string, url string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &googleError{method: method, url: url, status: resp.StatusCode, body: respData}
+	}
+	if out != nil && len(respData) > 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
+
+// googleError is an unsuccessful response from a Google API.
+type googleError struct {
+	method string
+	url    string
+	status int
+	body   []byte
+}
+
+func (e *googleError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.method, e.url, e.status, e.body)
+}
+
+// isGoogleNotFound reports whether err is a Google API's 404.
+func isGoogleNotFound(err error) bool {
+	var e *googleError
+	return errors.As(err, &e) && e.status == http.StatusNotFound
+}
+
+// Do sends the request and, when the response is a long running operation,
+// polls it until it is done.
+func (c *googleClient) Do(method string, url string, body interface{}, out interface{}) error {
+	var raw json.RawMessage
+	err := c.send(method, url, body, &raw)
+	if err != nil {
+		return err
+	}
+
+	var op struct {
+		Name  string `json:"name"`
+		Done  *bool  `json:"done"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(raw, &op)
+	if method != http.MethodGet && op.Done != nil && strings.Contains(op.Name, "operations/") {
+		base := url[:strings.Index(url, "/v1/")+len("/v1/")]
+		deadline := time.Now().Add(c.pollFor)
+		for !*op.Done {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for %s", op.Name)
+			}
+			time.Sleep(c.pollEvery)
+			err = c.send(http.MethodGet, base+op.Name, nil, &op)
+			if err != nil {
+				return err
+			}
+		}
+		if op.Error != nil {
+			return fmt.Errorf("%s failed: %s", op.Name, op.Error.Message)
+		}
+		return nil
+	}
+
+	if out != nil && len(raw) > 0 {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
+
+// Upload puts a source archive to a signed Cloud Functions upload URL.
+func (c *googleClient) Upload(uploadURL string, zipBytes []byte) error {
+	req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(zipBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set("x-goog-content-length-range", "0,104857600")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("uploading source returned %d: %s", resp.StatusCode, data)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package externalfunction
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeGCPClient serves Google API requests from a fakeCloud. POSTing to a
+// collection creates the resource named by the request, and a GET of an api's
+// configs lists those that exist.
+type fakeGCPClient struct {
+	*fakeCloud
+	token   string
+	uploads map[string][]byte
+}
+
+func newFakeGCPClient(token string) *fakeGCPClient {
+	return &fakeGCPClient{fakeCloud: newFakeCloud(), token: token, uploads: map[string][]byte{}}
+}
+
+func (c *fakeGCPClient) Do(method string, url string, body interface{}, out interface{}) error {
+	if created := gcpCreated(url, body); method == http.MethodPost && created != "" {
+		method, url = http.MethodPut, created
+	}
+	if method == http.MethodGet && strings.HasSuffix(url, "/configs") {
+		var configs []string
+		for resource := range c.resources {
+			if strings.HasPrefix(resource, url+"/") {
+				configs = append(configs, fmt.Sprintf(`{"name": %q}`, strings.TrimPrefix(resource, gcpAPIGatewayURL+"/")))
+			}
+		}
+		return json.Unmarshal([]byte(`{"apiConfigs": [`+strings.Join(configs, ", ")+`]}`), out)
+	}
+	status, err := c.do(method, url, body, out)
+	if status != 0 {
+		return &googleError{method: method, url: url, status: status}
+	}
+	return err
+}
+
+// gcpCreated is the resource POSTing body to url creates, if url is a
+// collection: its id is either a query parameter or, for functions, the
+// body's name.
+func gcpCreated(url string, body interface{}) string {
+	parts := strings.SplitN(url, "?", 2)
+	if len(parts) == 2 {
+		for _, param := range strings.Split(parts[1], "&") {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) == 2 && strings.HasSuffix(kv[0], "Id") {
+				return parts[0] + "/" + kv[1]
+			}
+		}
+		return ""
+	}
+	if function, ok := body.(map[string]interface{}); ok && strings.HasSuffix(url, "/functions") {
+		return gcpFunctionsURL + "/" + function["name"].(string)
+	}
+	return ""
+}
+
+func (c *fakeGCPClient) Upload(uploadURL string, zipBytes []byte) error {
+	c.writes++
+	c.uploads[uploadURL] = zipBytes
+	return nil
+}
+
+const (
+	testGCPFunctions = gcpFunctionsURL + "/projects/proj-1/locations/us-central1/functions"
+	testGCPFunction  = testGCPFunctions + "/echo-fn-function"
+	testGCPAPI       = gcpAPIGatewayURL + "/projects/proj-1/locations/global/apis/echo-fn-api"
+	testGCPGateway   = gcpAPIGatewayURL + "/projects/proj-1/locations/us-central1/gateways/echo-fn-gateway"
+	testGCPUploadURL = "https://storage.googleapis.com/uploads/echo-fn.zip"
+	testGCPInvoker   = "gateway@proj-1.iam.gserviceaccount.com"
+	testGCPSnowflake = "snowflake-123@sfc-prod.iam.gserviceaccount.com"
+)
+
+// plannedGCP is a GCP provider planned with the defaults and a fake client
+// filling in what GCP reports about the function, api and gateway.
+func plannedGCP(t *testing.T) (*GCPConfig, *fakeGCPClient) {
+	t.Helper()
+	var client *fakeGCPClient
+	saved := newGCPClient
+	newGCPClient = func(token string) gcpClient {
+		client = newFakeGCPClient(token)
+		return client
+	}
+	defer func() { newGCPClient = saved }()
+
+	cfg := NewGCPProvider(answering(t, map[string]string{
+		gcpUseEnvQuestion:          "No",
+		"GCP_ACCESS_TOKEN":         "token-1",
+		"GCP_PROJECT":              "proj-1",
+		gcpServiceAccountQuestion:  testGCPInvoker,
+		gcpDefaultFunctionQuestion: "Yes",
+	})).(*GCPConfig)
+	if err := cfg.Plan("echo_fn", "echo_fn(n int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.responses["POST "+testGCPFunctions+":generateUploadUrl"] = fmt.Sprintf(`{"uploadUrl": %q}`, testGCPUploadURL)
+	client.responses["GET "+testGCPFunction] = `{"httpsTrigger": {"url": "https://us-central1-proj-1.cloudfunctions.net/echo-fn-function"}}`
+	client.responses["GET "+testGCPAPI] = `{"managedService": "echo-fn-api-0abc.apigateway.proj-1.cloud.goog"}`
+	client.responses["GET "+testGCPGateway] = `{"defaultHostname": "echo-fn-gateway-0abc.uc.gateway.dev"}`
+	return cfg, client
+}
+
+func provisionedGCP(t *testing.T) (*GCPConfig, *fakeGCPClient) {
+	t.Helper()
+	cfg, client := plannedGCP(t)
+	if err := cfg.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, client
+}
+
+// openAPISpec decodes the spec of the api config configName.
+func (c *fakeGCPClient) openAPISpec(t *testing.T, configName string) string {
+	t.Helper()
+	config := c.resource(t, gcpAPIGatewayURL+"/"+configName)
+	if config["gatewayServiceAccount"] != testGCPInvoker {
+		t.Errorf("api config %s uses service account %v", configName, config["gatewayServiceAccount"])
+	}
+	document := config["openapiDocuments"].([]interface{})[0].(map[string]interface{})["document"].(map[string]interface{})
+	data, err := base64.StdEncoding.DecodeString(document["contents"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGCPPlan(t *testing.T) {
+	cfg, client := plannedGCP(t)
+	if client == nil || client.token != "token-1" {
+		t.Fatalf("Plan did not connect with the access token")
+	}
+	if cfg.project != "proj-1" || cfg.region != "us-central1" {
+		t.Errorf("Plan gathered project %q, region %q", cfg.project, cfg.region)
+	}
+	want := GCPResources{
+		functionName:          "echo-fn-function",
+		functionRuntime:       "python310",
+		functionEntryPoint:    "external_function",
+		apiName:               "echo-fn-api",
+		gatewayName:           "echo-fn-gateway",
+		gatewayServiceAccount: testGCPInvoker,
+	}
+	got := *cfg.Resources
+	got.functionZipBytes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan named\n%+v\nwant\n%+v", got, want)
+	}
+	if len(cfg.Resources.functionZipBytes) == 0 {
+		t.Errorf("Plan did not package the default function")
+	}
+}
+
+func TestGCPProvision(t *testing.T) {
+	cfg, client := provisionedGCP(t)
+
+	var created []string
+	for url := range client.resources {
+		created = append(created, url)
+	}
+	sort.Strings(created)
+	want := []string{testGCPAPI, gcpAPIGatewayURL + "/" + cfg.Resources.apiConfigName, testGCPGateway, testGCPFunction}
+	sort.Strings(want)
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("Provision created\n%s\nwant\n%s", strings.Join(created, "\n"), strings.Join(want, "\n"))
+	}
+	if string(client.uploads[testGCPUploadURL]) != string(cfg.Resources.functionZipBytes) {
+		t.Errorf("Provision did not upload the planned zip")
+	}
+	if got := cfg.Endpoint(); got != "https://echo-fn-gateway-0abc.uc.gateway.dev/" {
+		t.Errorf("Endpoint() = %q", got)
+	}
+	if gateway := client.resource(t, testGCPGateway); gateway["apiConfig"] != cfg.Resources.apiConfigName {
+		t.Errorf("gateway points at %v, want %s", gateway["apiConfig"], cfg.Resources.apiConfigName)
+	}
+
+	iam, _ := json.Marshal(client.posted[testGCPFunction+":setIamPolicy"])
+	if !strings.Contains(string(iam), `"members":["serviceAccount:`+testGCPInvoker+`"]`) {
+		t.Errorf("function is not restricted to the gateway's service account: %s", iam)
+	}
+
+	// Until Snowflake's service account is known only the gateway's own
+	// tokens are accepted
+	openAPISpec := client.openAPISpec(t, cfg.Resources.apiConfigName)
+	for _, want := range []string{
+		"address: https://us-central1-proj-1.cloudfunctions.net/echo-fn-function",
+		"operationId: echo_fn",
+		"x-google-issuer: " + testGCPInvoker,
+		"x-google-jwks_uri: https://www.googleapis.com/robot/v1/metadata/x509/" + testGCPInvoker,
+	} {
+		if !strings.Contains(openAPISpec, want) {
+			t.Errorf("api config is missing %s:\n%s", want, openAPISpec)
+		}
+	}
+}
+
+func TestGCPProvisionExisting(t *testing.T) {
+	cfg, client := plannedGCP(t)
+	// Recreating a resource would drop its labels
+	for _, url := range []string{testGCPFunction, testGCPAPI, testGCPGateway} {
+		client.resources[url] = `{"labels": {"team": "data"}}`
+	}
+	if err := cfg.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{testGCPFunction, testGCPAPI, testGCPGateway} {
+		if _, found := client.resource(t, url)["labels"]; !found {
+			t.Errorf("Provision recreated %s", url)
+		}
+	}
+	if function := client.resource(t, testGCPFunction); function["sourceUploadUrl"] != testGCPUploadURL {
+		t.Errorf("Provision did not redeploy the function's source")
+	}
+	if gateway := client.resource(t, testGCPGateway); gateway["apiConfig"] != cfg.Resources.apiConfigName {
+		t.Errorf("gateway points at %v, want %s", gateway["apiConfig"], cfg.Resources.apiConfigName)
+	}
+}
+
+func TestGCPProvisionLookupFailure(t *testing.T) {
+	cfg, client := plannedGCP(t)
+	client.statuses["GET "+testGCPFunction] = http.StatusForbidden
+	if err := cfg.Provision(); !strings.Contains(fmt.Sprint(err), "returned 403") {
+		t.Fatalf("Provision() = %v, want the 403 looking the function up", err)
+	}
+	if _, found := client.resources[testGCPFunction]; found {
+		t.Errorf("Provision created a function it could not look up")
+	}
+}
+
+func TestGCPIntegrationSQL(t *testing.T) {
+	cfg, _ := provisionedGCP(t)
+	want := `create api integration if not exists echo_fn_api_integration
+	api_provider = google_api_gateway
+	google_audience = 'echo-fn-api-0abc.apigateway.proj-1.cloud.goog'
+	api_allowed_prefixes = ('https://echo-fn-gateway-0abc.uc.gateway.dev/')
+	enabled = true;`
+	if got := cfg.IntegrationSQL("echo_fn_api_integration"); got != want {
+		t.Errorf("IntegrationSQL() =\n%s\nwant\n%s", got, want)
+	}
+	want = `alter api integration echo_fn_api_integration set
+	api_allowed_prefixes = ('https://echo-fn-gateway-0abc.uc.gateway.dev/')
+	enabled = true;`
+	if got := cfg.IntegrationUpdateSQL("echo_fn_api_integration"); got != want {
+		t.Errorf("IntegrationUpdateSQL() =\n%s\nwant\n%s", got, want)
+	}
+	if got := cfg.IdentityProperty(); got != "API_GCP_SERVICE_ACCOUNT" {
+		t.Errorf("IdentityProperty() = %q", got)
+	}
+	if _, ok := Provider(cfg).(Truster); ok {
+		t.Errorf("GCP trusts Snowflake's service account without an external id")
+	}
+}
+
+func TestGCPTrustIdentity(t *testing.T) {
+	cfg, client := provisionedGCP(t)
+	if err := cfg.TrustIdentity(testGCPSnowflake); err != nil {
+		t.Fatal(err)
+	}
+	if gateway := client.resource(t, testGCPGateway); gateway["apiConfig"] != cfg.Resources.apiConfigName {
+		t.Errorf("gateway points at %v, want %s", gateway["apiConfig"], cfg.Resources.apiConfigName)
+	}
+	openAPISpec := client.openAPISpec(t, cfg.Resources.apiConfigName)
+	if !strings.Contains(openAPISpec, "x-google-issuer: "+testGCPSnowflake) {
+		t.Errorf("api config does not trust Snowflake's service account:\n%s", openAPISpec)
+	}
+
+	client.writes = 0
+	if err := cfg.TrustIdentity(""); err == nil {
+		t.Error("TrustIdentity succeeded without a service account")
+	}
+	if client.writes > 0 {
+		t.Errorf("TrustIdentity changed the gateway without a service account")
+	}
+}
+
+func TestGCPDestroy(t *testing.T) {
+	cfg, client := provisionedGCP(t)
+	if err := cfg.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.resources) > 0 {
+		t.Errorf("Destroy left %v", client.resources)
+	}
+}
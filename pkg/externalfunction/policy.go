@@ -0,0 +1,664 @@
+package externalfunction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	PolicyVersion = "2012-10-17"
+	// LegacyPolicyVersion is still found on existing documents, e.g. the
+	// default VPC endpoint policy.
+	LegacyPolicyVersion = "2008-10-17"
+
+	EffectAllow = "Allow"
+	EffectDeny  = "Deny"
+)
+
+// Names of the policy documents goflake generates; these are the keys users
+// extend them by in the spec's "policies" section.
+const (
+	LambdaTrustPolicyName     = "lambda-trust"
+	LambdaExecutionPolicyName = "lambda-execution"
+	GatewayTrustPolicyName    = "gateway-trust"
+	GatewayInvokePolicyName   = "gateway-invoke"
+	APIResourcePolicyName     = "api-resource"
+)
+
+// PolicyDocument is an IAM policy (identity, trust or resource based).
+type PolicyDocument struct {
+	Version   string      `json:"Version"`
+	ID        string      `json:"Id,omitempty"`
+	Statement []Statement `json:"Statement"`
+}
+
+// Statement is a single IAM policy statement.
+type Statement struct {
+	Sid          string     `json:"Sid,omitempty"`
+	Effect       string     `json:"Effect"`
+	Principal    *Principal `json:"Principal,omitempty"`
+	NotPrincipal *Principal `json:"NotPrincipal,omitempty"`
+	Action       StringList `json:"Action,omitempty"`
+	NotAction    StringList `json:"NotAction,omitempty"`
+	Resource     StringList `json:"Resource,omitempty"`
+	NotResource  StringList `json:"NotResource,omitempty"`
+	Condition    Conditions `json:"Condition,omitempty"`
+}
+
+// Principal is either every principal ("*") or a set of typed principals.
+type Principal struct {
+	All           bool       `json:"-"`
+	AWS           StringList `json:"AWS,omitempty"`
+	Service       StringList `json:"Service,omitempty"`
+	Federated     StringList `json:"Federated,omitempty"`
+	CanonicalUser StringList `json:"CanonicalUser,omitempty"`
+}
+
+// Conditions maps a condition operator (StringEquals, IpAddress, ...) to its
+// condition keys and their values.
+type Conditions map[string]map[string]StringList
+
+// StringList serializes a single value as a string and several as an array,
+// and accepts either form.
+type StringList []string
+
+func NewPolicyDocument(statements ...Statement) *PolicyDocument {
+	return &PolicyDocument{Version: PolicyVersion, Statement: statements}
+}
+
+func (l StringList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (p Principal) MarshalJSON() ([]byte, error) {
+	if p.All {
+		return json.Marshal("*")
+	}
+	type principal Principal
+	return json.Marshal(principal(p))
+}
+
+func (p *Principal) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != "*" {
+			return fmt.Errorf("unsupported principal %q", all)
+		}
+		*p = Principal{All: true}
+		return nil
+	}
+	type principal Principal
+	var pp principal
+	if err := json.Unmarshal(data, &pp); err != nil {
+		return err
+	}
+	*p = Principal(pp)
+	return nil
+}
+
+// UnmarshalJSON accepts a lone statement object as well as a list.
+func (d *PolicyDocument) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Version   string          `json:"Version"`
+		ID        string          `json:"Id"`
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	d.Version = raw.Version
+	d.ID = raw.ID
+	d.Statement = nil
+	if len(raw.Statement) == 0 {
+		return nil
+	}
+	var single Statement
+	if err := json.Unmarshal(raw.Statement, &single); err == nil {
+		d.Statement = []Statement{single}
+		return nil
+	}
+	return json.Unmarshal(raw.Statement, &d.Statement)
+}
+
+// ParsePolicyDocument decodes a policy document, e.g. one returned by IAM or
+// API Gateway.
+func ParsePolicyDocument(document string) (*PolicyDocument, error) {
+	d := &PolicyDocument{}
+	if err := json.Unmarshal([]byte(document), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// AddCondition adds values for key under operator, keeping existing values.
+func (s *Statement) AddCondition(operator string, key string, values ...string) {
+	if s.Condition == nil {
+		s.Condition = Conditions{}
+	}
+	if s.Condition[operator] == nil {
+		s.Condition[operator] = map[string]StringList{}
+	}
+	s.Condition[operator][key] = append(s.Condition[operator][key], values...)
+}
+
+// PutStatement replaces the statement sharing s's Sid, or appends s.
+func (d *PolicyDocument) PutStatement(s Statement) {
+	for i := range d.Statement {
+		if s.Sid != "" && d.Statement[i].Sid == s.Sid {
+			d.Statement[i] = s
+			return
+		}
+	}
+	d.Statement = append(d.Statement, s)
+}
+
+// RemoveStatement drops the statement with the given Sid, reporting whether
+// one was found.
+func (d *PolicyDocument) RemoveStatement(sid string) bool {
+	for i := range d.Statement {
+		if d.Statement[i].Sid == sid {
+			d.Statement = append(d.Statement[:i], d.Statement[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the document is well formed enough for IAM to accept it.
+func (d *PolicyDocument) Validate() error {
+	if d.Version != PolicyVersion && d.Version != LegacyPolicyVersion {
+		return fmt.Errorf("policy version must be %s, not %q", PolicyVersion, d.Version)
+	}
+	if len(d.Statement) == 0 {
+		return fmt.Errorf("policy has no statements")
+	}
+	sids := map[string]bool{}
+	for i, s := range d.Statement {
+		if s.Effect != EffectAllow && s.Effect != EffectDeny {
+			return fmt.Errorf("statement %d: effect must be %s or %s, not %q", i, EffectAllow, EffectDeny, s.Effect)
+		}
+		if len(s.Action) == 0 && len(s.NotAction) == 0 {
+			return fmt.Errorf("statement %d: no action", i)
+		}
+		if s.Sid != "" {
+			if sids[s.Sid] {
+				return fmt.Errorf("statement %d: duplicate sid %s", i, s.Sid)
+			}
+			sids[s.Sid] = true
+		}
+		for op, keys := range s.Condition {
+			for key, values := range keys {
+				if len(values) == 0 {
+					return fmt.Errorf("statement %d: condition %s %s has no values", i, op, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// JSON validates and serializes the document.
+func (d *PolicyDocument) JSON() (string, error) {
+	if err := d.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// PolicyExtension is how users add to a generated policy from the spec:
+// Statements are appended and Conditions are added to every generated
+// statement.
+type PolicyExtension struct {
+	Statements []Statement `json:"statements,omitempty"`
+	Conditions Conditions  `json:"conditions,omitempty"`
+}
+
+// extendPolicy applies the spec's extension for the named policy, if any.
+// Extension statements get a Goflake Sid, so they are replaced, dropped from
+// the spec and withdrawn like the generated ones in policies goflake shares.
+func extendPolicy(name string, d *PolicyDocument) *PolicyDocument {
+	ext, found := spec.Policies[name]
+	if !found {
+		return d
+	}
+	for i := range d.Statement {
+		for op, keys := range ext.Conditions {
+			for key, values := range keys {
+				d.Statement[i].AddCondition(op, key, values...)
+			}
+		}
+	}
+	for i, s := range ext.Statements {
+		s.Sid = ExtensionSid(i, s.Sid)
+		d.Statement = append(d.Statement, s)
+	}
+	return d
+}
+
+// ExtensionSid is the Sid of the i-th extension statement of a policy,
+// keeping the alphanumerics of the Sid the spec gave it.
+func ExtensionSid(i int, sid string) string {
+	return fmt.Sprintf("%sExtension%d%s", GoflakeSidPrefix, i, sidSafe(sid))
+}
+
+// dropLegacyExtensions drops the named policy's extension statements as they
+// were written before they had Goflake Sids, i.e. verbatim from the spec.
+func (d *PolicyDocument) dropLegacyExtensions(name string) {
+	legacy := spec.Policies[name].Statements
+	remaining := d.Statement[:0]
+	for _, s := range d.Statement {
+		found := false
+		for _, l := range legacy {
+			found = found || reflect.DeepEqual(s, l)
+		}
+		if !found {
+			remaining = append(remaining, s)
+		}
+	}
+	d.Statement = remaining
+}
+
+// LambdaTrustPolicy lets the lambda service assume the lambda's role.
+func LambdaTrustPolicy() *PolicyDocument {
+	return extendPolicy(LambdaTrustPolicyName, NewPolicyDocument(Statement{
+		Effect:    EffectAllow,
+		Principal: &Principal{Service: StringList{"lambda.amazonaws.com"}},
+		Action:    StringList{"sts:AssumeRole"},
+	}))
+}
+
+// LambdaPermissions are the optional features the lambda's execution role
+// needs extra permissions for.
+type LambdaPermissions struct {
+	KMSKeyARN string
+	VPC       bool
+	XRay      bool
+}
+
+// LambdaExecutionPolicy lets the lambda write to its own log group only,
+// plus whatever the enabled features require.
+func LambdaExecutionPolicy(logGroupARN string, perms LambdaPermissions) *PolicyDocument {
+	d := NewPolicyDocument(
+		Statement{
+			Sid:      "CreateLogGroup",
+			Effect:   EffectAllow,
+			Action:   StringList{"logs:CreateLogGroup"},
+			Resource: StringList{logGroupARN},
+		},
+		Statement{
+			Sid:    "WriteLogs",
+			Effect: EffectAllow,
+			Action: StringList{
+				"logs:CreateLogStream",
+				"logs:PutLogEvents",
+			},
+			Resource: StringList{logGroupARN + ":*"},
+		})
+	if perms.KMSKeyARN != "" {
+		d.Statement = append(d.Statement, Statement{
+			Sid:      "DecryptEnvironment",
+			Effect:   EffectAllow,
+			Action:   StringList{"kms:Decrypt"},
+			Resource: StringList{perms.KMSKeyARN},
+		})
+	}
+	if perms.VPC {
+		// ENI management cannot be scoped to a resource
+		d.Statement = append(d.Statement, Statement{
+			Sid:    "ManageNetworkInterfaces",
+			Effect: EffectAllow,
+			Action: StringList{
+				"ec2:CreateNetworkInterface",
+				"ec2:DescribeNetworkInterfaces",
+				"ec2:DeleteNetworkInterface",
+				"ec2:AssignPrivateIpAddresses",
+				"ec2:UnassignPrivateIpAddresses",
+			},
+			Resource: StringList{"*"},
+		})
+	}
+	if perms.XRay {
+		d.Statement = append(d.Statement, Statement{
+			Sid:    "WriteTraces",
+			Effect: EffectAllow,
+			Action: StringList{
+				"xray:PutTraceSegments",
+				"xray:PutTelemetryRecords",
+			},
+			Resource: StringList{"*"},
+		})
+	}
+	return extendPolicy(LambdaExecutionPolicyName, d)
+}
+
+// GatewayTrustPolicy lets Snowflake's IAM user assume the gateway role when it
+// presents the integration's external id.
+func GatewayTrustPolicy(iamUserARN string, externalID string) *PolicyDocument {
+	s := Statement{
+		Sid:       SnowflakeTrustSid(externalID),
+		Effect:    EffectAllow,
+		Principal: &Principal{AWS: StringList{iamUserARN}},
+		Action:    StringList{"sts:AssumeRole"},
+	}
+	s.AddCondition("StringEquals", "sts:ExternalId", externalID)
+	return extendPolicy(GatewayTrustPolicyName, NewPolicyDocument(s))
+}
+
+// PlaceholderExternalID is required by the bootstrap trust until Snowflake's
+// own external id is known.
+const PlaceholderExternalID = "0000"
+
+// GatewayBootstrapTrustPolicy is the gateway role's trust before the API
+// integration exists: only the role's own account may assume it, and only
+// with the placeholder external id.
+func GatewayBootstrapTrustPolicy(accountRootARN string) *PolicyDocument {
+	s := Statement{
+		Sid:       BootstrapTrustSid,
+		Effect:    EffectAllow,
+		Principal: &Principal{AWS: StringList{accountRootARN}},
+		Action:    StringList{"sts:AssumeRole"},
+	}
+	s.AddCondition("StringEquals", "sts:ExternalId", PlaceholderExternalID)
+	return NewPolicyDocument(s)
+}
+
+// BootstrapTrustSid identifies the placeholder statement of the bootstrap trust.
+const BootstrapTrustSid = GoflakeSidPrefix + "Bootstrap"
+
+// SnowflakeTrustSid identifies the trust statement of one Snowflake account.
+// A Snowflake account has a single integration per gateway, and the account
+// (the part of the external id before _SFCRole) survives the integration being
+// recreated with a new external id, so its statement is replaced rather than
+// left behind. External ids of an unexpected form fall back to a digest.
+func SnowflakeTrustSid(externalID string) string {
+	var account string
+	if i := strings.Index(externalID, "_SFCRole"); i >= 0 {
+		account = sidSafe(externalID[:i])
+	}
+	if account == "" {
+		sum := sha256.Sum256([]byte(externalID))
+		account = hex.EncodeToString(sum[:4])
+	}
+	return GoflakeSidPrefix + "Snowflake" + account
+}
+
+// sidSafe drops everything but the alphanumerics IAM allows in a Sid.
+func sidSafe(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// AddSnowflakeTrust lets one more Snowflake account assume the role and
+// returns the external ids its statement trusted before, if they drifted. The
+// placeholder trust and statements written before trust statements had Sids
+// are replaced too; the other accounts' statements are left alone.
+func (d *PolicyDocument) AddSnowflakeTrust(iamUserARN string, externalID string) (drifted []string) {
+	sid := SnowflakeTrustSid(externalID)
+	for _, s := range d.Statement {
+		if s.Sid != sid {
+			continue
+		}
+		for _, id := range s.Condition["StringEquals"]["sts:ExternalId"] {
+			if id != externalID {
+				drifted = append(drifted, id)
+			}
+		}
+	}
+	d.removeTrust(PlaceholderExternalID)
+	d.removeTrust(externalID)
+	d.removeUnnamedTrust(iamUserARN)
+	for _, s := range GatewayTrustPolicy(iamUserARN, externalID).Statement {
+		if s.Sid == "" && d.containsStatement(s) {
+			continue
+		}
+		d.PutStatement(s)
+	}
+	if d.Version == "" {
+		d.Version = PolicyVersion
+	}
+	return drifted
+}
+
+// RemoveSnowflakeTrust drops the statements for externalID and reports
+// whether any were found.
+func (d *PolicyDocument) RemoveSnowflakeTrust(externalID string) bool {
+	return d.removeTrust(externalID)
+}
+
+// SnowflakeTrusts returns the external ids the role is currently trusting,
+// keyed by the IAM user presenting them.
+func (d *PolicyDocument) SnowflakeTrusts() map[string][]string {
+	trusts := map[string][]string{}
+	for _, s := range d.Statement {
+		if s.Effect != EffectAllow || s.Principal == nil {
+			continue
+		}
+		for _, id := range s.Condition["StringEquals"]["sts:ExternalId"] {
+			if id == PlaceholderExternalID {
+				continue
+			}
+			for _, user := range s.Principal.AWS {
+				trusts[user] = append(trusts[user], id)
+			}
+		}
+	}
+	return trusts
+}
+
+// removeTrust drops every statement conditioned on externalID, including
+// statements written before trust statements had Sids.
+func (d *PolicyDocument) removeTrust(externalID string) bool {
+	remaining := d.Statement[:0]
+	for _, s := range d.Statement {
+		if !contains(s.Condition["StringEquals"]["sts:ExternalId"], externalID) {
+			remaining = append(remaining, s)
+		}
+	}
+	removed := len(remaining) < len(d.Statement)
+	d.Statement = remaining
+	return removed
+}
+
+// removeUnnamedTrust drops the Sid-less statements trusting principal with an
+// external id, as written by goflake before each account had its own Sid.
+func (d *PolicyDocument) removeUnnamedTrust(principal string) {
+	remaining := d.Statement[:0]
+	for _, s := range d.Statement {
+		if s.Sid == "" && s.Principal != nil && contains(s.Principal.AWS, principal) &&
+			len(s.Condition["StringEquals"]["sts:ExternalId"]) > 0 {
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	d.Statement = remaining
+}
+
+// trusts reports whether an Allow statement lets principal assume the role
+// with externalID (any external id when empty).
+func (d *PolicyDocument) trusts(principal string, externalID string) bool {
+	for _, s := range d.Statement {
+		if s.Effect != EffectAllow || s.Principal == nil || !contains(s.Principal.AWS, principal) {
+			continue
+		}
+		if externalID == "" || contains(s.Condition["StringEquals"]["sts:ExternalId"], externalID) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustsService reports whether any Allow statement trusts an AWS service.
+func (d *PolicyDocument) trustsService() bool {
+	for _, s := range d.Statement {
+		if s.Effect == EffectAllow && s.Principal != nil && (s.Principal.All || len(s.Principal.Service) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GatewayInvokePolicy lets the gateway role invoke the REST API.
+func GatewayInvokePolicy(executeARN string) *PolicyDocument {
+	return extendPolicy(GatewayInvokePolicyName, NewPolicyDocument(Statement{
+		Effect:   EffectAllow,
+		Action:   StringList{"execute-api:Invoke"},
+		Resource: StringList{executeARN},
+	}))
+}
+
+// InvokerTrustSid identifies the statement trusting whoever signs a direct
+// invocation as the gateway role; it only exists while they invoke.
+const InvokerTrustSid = GoflakeSidPrefix + "Invoker"
+
+// InvokerInvokeSid identifies the REST API resource policy statement admitting
+// direct invocations.
+const InvokerInvokeSid = GoflakeSidPrefix + "InvokerInvoke"
+
+// InvokerTrustStatement lets principal assume the gateway role without an
+// external id.
+func InvokerTrustStatement(principal string) Statement {
+	return Statement{
+		Sid:       InvokerTrustSid,
+		Effect:    EffectAllow,
+		Principal: &Principal{AWS: StringList{principal}},
+		Action:    StringList{"sts:AssumeRole"},
+	}
+}
+
+// Sids of the statements goflake owns in policies it shares with others
+// (REST API resource policies, VPC endpoint policies).
+const (
+	GoflakeSidPrefix      = "Goflake"
+	SnowflakeInvokeSid    = GoflakeSidPrefix + "SnowflakeInvoke"
+	DenyOutsideVpceSid    = GoflakeSidPrefix + "DenyOutsideVpce"
+	DenyOutsideIPRangeSid = GoflakeSidPrefix + "DenyOutsideIPRange"
+)
+
+// APIResourcePolicy lets the gateway role's Snowflake session invoke the
+// REST API. When vpcEndpointIDs are given every request that did not arrive
+// through one of them is denied, and likewise for sourceIPRanges.
+func APIResourcePolicy(sessionARN string, executeARN string, vpcEndpointIDs []string, sourceIPRanges []string) *PolicyDocument {
+	d := NewPolicyDocument(SnowflakeInvokeStatement(SnowflakeInvokeSid, sessionARN, executeARN))
+	if len(vpcEndpointIDs) > 0 {
+		deny := denyInvokeStatement(DenyOutsideVpceSid, executeARN)
+		deny.AddCondition("StringNotEquals", "aws:SourceVpce", vpcEndpointIDs...)
+		d.Statement = append(d.Statement, deny)
+	}
+	if len(sourceIPRanges) > 0 {
+		deny := denyInvokeStatement(DenyOutsideIPRangeSid, executeARN)
+		deny.AddCondition("NotIpAddress", "aws:SourceIp", sourceIPRanges...)
+		d.Statement = append(d.Statement, deny)
+	}
+	return extendPolicy(APIResourcePolicyName, d)
+}
+
+func denyInvokeStatement(sid string, executeARN string) Statement {
+	return Statement{
+		Sid:       sid,
+		Effect:    EffectDeny,
+		Principal: &Principal{All: true},
+		Action:    StringList{"execute-api:Invoke"},
+		Resource:  StringList{executeARN},
+	}
+}
+
+// MergeOwned folds owned into d: statements sharing a Sid are replaced,
+// statements d already contains verbatim are skipped and statements whose Sid
+// starts with prefix but are no longer in owned are dropped. Everything else
+// in d is left as is.
+func (d *PolicyDocument) MergeOwned(owned *PolicyDocument, prefix string) {
+	keep := map[string]bool{}
+	for _, s := range owned.Statement {
+		keep[s.Sid] = true
+	}
+	merged := d.Statement[:0]
+	for _, s := range d.Statement {
+		if strings.HasPrefix(s.Sid, prefix) && !keep[s.Sid] {
+			continue
+		}
+		merged = append(merged, s)
+	}
+	d.Statement = merged
+	for _, s := range owned.Statement {
+		if s.Sid == "" && d.containsStatement(s) {
+			continue
+		}
+		d.PutStatement(s)
+	}
+	if d.Version == "" {
+		d.Version = PolicyVersion
+	}
+}
+
+// RemoveOwned drops every statement whose Sid starts with prefix and reports
+// whether any statements remain.
+func (d *PolicyDocument) RemoveOwned(prefix string) bool {
+	remaining := d.Statement[:0]
+	for _, s := range d.Statement {
+		if !strings.HasPrefix(s.Sid, prefix) {
+			remaining = append(remaining, s)
+		}
+	}
+	d.Statement = remaining
+	return len(d.Statement) > 0
+}
+
+func (d *PolicyDocument) containsStatement(s Statement) bool {
+	for _, existing := range d.Statement {
+		if reflect.DeepEqual(existing, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SnowflakeInvokeStatement allows an assumed role session, normally
+// Snowflake's, to invoke the API.
+func SnowflakeInvokeStatement(sid string, sessionARN string, executeARN string) Statement {
+	return Statement{
+		Sid:       sid,
+		Effect:    EffectAllow,
+		Principal: &Principal{AWS: StringList{sessionARN}},
+		Action:    StringList{"execute-api:Invoke"},
+		Resource:  StringList{executeARN},
+	}
+}
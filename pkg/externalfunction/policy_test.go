@@ -0,0 +1,371 @@
+package externalfunction
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	testLogGroupARN = "arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/echo-lambda"
+	testExecuteARN  = "arn:aws:execute-api:us-east-1:123456789012:abc123/*"
+	testSessionARN  = "arn:aws:sts::123456789012:assumed-role/echo-gateway-role/snowflake"
+	testIAMUserARN  = "arn:aws:iam::987654321098:user/abc1-s-v2st0000"
+	testExternalID  = "MYACCOUNT_SFCRole=2_abcdefghijklmnopqrstuvwxyz0="
+	testKMSKeyARN   = "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+)
+
+// withSpec runs f with s as the package spec.
+func withSpec(s *Spec, f func()) {
+	previous := spec
+	spec = s
+	defer func() { spec = previous }()
+	f()
+}
+
+// assertGolden compares the document's JSON to testdata/<name>.json.
+func assertGolden(t *testing.T, name string, d *PolicyDocument) {
+	t.Helper()
+	got, err := d.JSON()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	path := filepath.Join("testdata", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %v (run go test -update to create it)", name, err)
+	}
+	if got+"\n" != string(want) {
+		t.Errorf("%s differs from %s:\n%s", name, path, got)
+	}
+}
+
+func TestGeneratedPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		document func() *PolicyDocument
+	}{
+		{"lambda-trust", LambdaTrustPolicy},
+		{"lambda-execution", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{})
+		}},
+		{"lambda-execution-vpc", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{VPC: true})
+		}},
+		{"lambda-execution-kms", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{KMSKeyARN: testKMSKeyARN})
+		}},
+		{"lambda-execution-xray", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{XRay: true})
+		}},
+		{"lambda-execution-all", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{KMSKeyARN: testKMSKeyARN, VPC: true, XRay: true})
+		}},
+		{"gateway-trust-bootstrap", func() *PolicyDocument {
+			return GatewayBootstrapTrustPolicy("arn:aws:iam::123456789012:root")
+		}},
+		{"gateway-trust-snowflake", func() *PolicyDocument {
+			return GatewayTrustPolicy(testIAMUserARN, testExternalID)
+		}},
+		{"gateway-trust-invoker", func() *PolicyDocument {
+			d := GatewayTrustPolicy(testIAMUserARN, testExternalID)
+			d.PutStatement(InvokerTrustStatement("arn:aws:iam::123456789012:role/admin"))
+			return d
+		}},
+		{"gateway-invoke", func() *PolicyDocument {
+			return GatewayInvokePolicy(testExecuteARN)
+		}},
+		{"api-resource-public", func() *PolicyDocument {
+			return APIResourcePolicy(testSessionARN, testExecuteARN, nil, nil)
+		}},
+		{"api-resource-private", func() *PolicyDocument {
+			return APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d", "vpce-4e5f6a7b"}, nil)
+		}},
+		{"api-resource-ip-restricted", func() *PolicyDocument {
+			return APIResourcePolicy(testSessionARN, testExecuteARN, nil, []string{"203.0.113.0/24"})
+		}},
+		{"api-resource-private-ip-restricted", func() *PolicyDocument {
+			return APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, []string{"203.0.113.0/24", "198.51.100.7/32"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSpec(&Spec{}, func() {
+				assertGolden(t, tt.name, tt.document())
+			})
+		})
+	}
+}
+
+// testExtensions extends every generated policy with a condition and a statement.
+func testExtensions() *Spec {
+	ext := func(sid string, action string) PolicyExtension {
+		return PolicyExtension{
+			Statements: []Statement{{
+				Sid:      sid,
+				Effect:   EffectAllow,
+				Action:   StringList{action},
+				Resource: StringList{"*"},
+			}},
+			Conditions: Conditions{"StringEquals": {"aws:PrincipalOrgID": StringList{"o-abc123"}}},
+		}
+	}
+	return &Spec{Policies: map[string]PolicyExtension{
+		LambdaTrustPolicyName:     ext("", "sts:TagSession"),
+		LambdaExecutionPolicyName: ext("ReadSecrets", "secretsmanager:GetSecretValue"),
+		GatewayTrustPolicyName:    ext("Tag-Session", "sts:TagSession"),
+		GatewayInvokePolicyName:   ext("", "execute-api:ManageConnections"),
+		APIResourcePolicyName: {
+			Statements: []Statement{{
+				Sid:       "AllowMonitoring",
+				Effect:    EffectAllow,
+				Principal: &Principal{AWS: StringList{"arn:aws:iam::123456789012:role/monitoring"}},
+				Action:    StringList{"execute-api:Invoke"},
+				Resource:  StringList{testExecuteARN},
+			}},
+		},
+	}}
+}
+
+func TestExtendedPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		document func() *PolicyDocument
+	}{
+		{"lambda-trust-extended", LambdaTrustPolicy},
+		{"lambda-execution-extended", func() *PolicyDocument {
+			return LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{XRay: true})
+		}},
+		{"gateway-trust-snowflake-extended", func() *PolicyDocument {
+			return GatewayTrustPolicy(testIAMUserARN, testExternalID)
+		}},
+		// The bootstrap trust is never extended
+		{"gateway-trust-bootstrap", func() *PolicyDocument {
+			return GatewayBootstrapTrustPolicy("arn:aws:iam::123456789012:root")
+		}},
+		{"gateway-invoke-extended", func() *PolicyDocument {
+			return GatewayInvokePolicy(testExecuteARN)
+		}},
+		{"api-resource-extended", func() *PolicyDocument {
+			return APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSpec(testExtensions(), func() {
+				assertGolden(t, tt.name, tt.document())
+			})
+		})
+	}
+}
+
+func TestInvokerTrust(t *testing.T) {
+	withSpec(&Spec{}, func() {
+		d := GatewayTrustPolicy(testIAMUserARN, testExternalID)
+		d.PutStatement(InvokerTrustStatement("arn:aws:iam::123456789012:role/admin"))
+		want := map[string][]string{testIAMUserARN: {testExternalID}}
+		if got := d.SnowflakeTrusts(); !reflect.DeepEqual(got, want) {
+			t.Errorf("SnowflakeTrusts() = %v, want %v", got, want)
+		}
+		if !d.RemoveStatement(InvokerTrustSid) {
+			t.Fatal("the invoker's statement was not found")
+		}
+		assertGolden(t, "gateway-trust-snowflake", d)
+	})
+}
+
+func TestExtensionSid(t *testing.T) {
+	tests := []struct {
+		i    int
+		sid  string
+		want string
+	}{
+		{0, "", "GoflakeExtension0"},
+		{1, "ReadSecrets", "GoflakeExtension1ReadSecrets"},
+		{2, "Tag-Session_2", "GoflakeExtension2TagSession2"},
+	}
+	for _, tt := range tests {
+		if got := ExtensionSid(tt.i, tt.sid); got != tt.want {
+			t.Errorf("ExtensionSid(%d, %q) = %q, want %q", tt.i, tt.sid, got, tt.want)
+		}
+	}
+}
+
+// sharedAPIPolicy is a resource policy another tool wrote, goflake's
+// statements merged into it.
+func sharedAPIPolicy(t *testing.T) *PolicyDocument {
+	t.Helper()
+	d, err := ParsePolicyDocument(`{
+  "Version": "2012-10-17",
+  "Statement": {
+    "Sid": "AllowPartner",
+    "Effect": "Allow",
+    "Principal": {"AWS": "arn:aws:iam::111122223333:root"},
+    "Action": "execute-api:Invoke",
+    "Resource": "arn:aws:execute-api:us-east-1:123456789012:abc123/*/GET/partner"
+  }
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestMergeOwned(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  *Spec
+		vpces []string
+	}{
+		// Goflake's statements are added next to the others
+		{"merge-shared", &Spec{}, []string{"vpce-0a1b2c3d"}},
+		// and extension statements with them
+		{"merge-shared-extended", testExtensions(), []string{"vpce-0a1b2c3d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSpec(tt.spec, func() {
+				d := sharedAPIPolicy(t)
+				d.MergeOwned(APIResourcePolicy(testSessionARN, testExecuteARN, tt.vpces, nil), GoflakeSidPrefix)
+				assertGolden(t, tt.name, d)
+			})
+		})
+	}
+
+	t.Run("idempotent", func(t *testing.T) {
+		withSpec(testExtensions(), func() {
+			d := sharedAPIPolicy(t)
+			owned := APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, nil)
+			d.MergeOwned(owned, GoflakeSidPrefix)
+			d.MergeOwned(owned, GoflakeSidPrefix)
+			assertGolden(t, "merge-shared-extended", d)
+		})
+	})
+
+	t.Run("drops removed statements", func(t *testing.T) {
+		d := sharedAPIPolicy(t)
+		withSpec(testExtensions(), func() {
+			d.MergeOwned(APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, nil), GoflakeSidPrefix)
+		})
+		// The extension and the private endpoint were dropped from the spec
+		withSpec(&Spec{}, func() {
+			d.MergeOwned(APIResourcePolicy(testSessionARN, testExecuteARN, nil, nil), GoflakeSidPrefix)
+		})
+		assertGolden(t, "merge-shared-dropped", d)
+	})
+
+	t.Run("migrates legacy extensions", func(t *testing.T) {
+		withSpec(testExtensions(), func() {
+			d := sharedAPIPolicy(t)
+			// As written before extension statements had Goflake Sids
+			d.Statement = append(d.Statement, spec.Policies[APIResourcePolicyName].Statements...)
+			d.dropLegacyExtensions(APIResourcePolicyName)
+			d.MergeOwned(APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, nil), GoflakeSidPrefix)
+			assertGolden(t, "merge-shared-extended", d)
+		})
+	})
+}
+
+func TestRemoveOwned(t *testing.T) {
+	withSpec(testExtensions(), func() {
+		d := sharedAPIPolicy(t)
+		d.MergeOwned(APIResourcePolicy(testSessionARN, testExecuteARN, []string{"vpce-0a1b2c3d"}, []string{"203.0.113.0/24"}), GoflakeSidPrefix)
+		if !d.RemoveOwned(GoflakeSidPrefix) {
+			t.Fatal("RemoveOwned dropped the other statements")
+		}
+		assertGolden(t, "remove-owned", d)
+
+		owned := APIResourcePolicy(testSessionARN, testExecuteARN, nil, nil)
+		if owned.RemoveOwned(GoflakeSidPrefix) {
+			t.Errorf("RemoveOwned left statements in a policy goflake owns: %v", owned.Statement)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	allow := Statement{Effect: EffectAllow, Action: StringList{"sts:AssumeRole"}}
+	tests := []struct {
+		name     string
+		document *PolicyDocument
+		err      string
+	}{
+		{"valid", NewPolicyDocument(allow), ""},
+		{"legacy version", &PolicyDocument{Version: LegacyPolicyVersion, Statement: []Statement{allow}}, ""},
+		{"not action", NewPolicyDocument(Statement{Effect: EffectDeny, NotAction: StringList{"s3:*"}}), ""},
+		{"no version", &PolicyDocument{Statement: []Statement{allow}}, `policy version must be 2012-10-17, not ""`},
+		{"bad version", &PolicyDocument{Version: "2020-01-01", Statement: []Statement{allow}}, `policy version must be 2012-10-17, not "2020-01-01"`},
+		{"no statements", NewPolicyDocument(), "policy has no statements"},
+		{"bad effect", NewPolicyDocument(allow, Statement{Effect: "allow", Action: StringList{"s3:*"}}), `statement 1: effect must be Allow or Deny, not "allow"`},
+		{"no action", NewPolicyDocument(Statement{Effect: EffectAllow, Resource: StringList{"*"}}), "statement 0: no action"},
+		{"duplicate sid", NewPolicyDocument(
+			Statement{Sid: "Same", Effect: EffectAllow, Action: StringList{"s3:GetObject"}},
+			Statement{Sid: "Same", Effect: EffectAllow, Action: StringList{"s3:PutObject"}},
+		), "statement 1: duplicate sid Same"},
+		{"empty condition", NewPolicyDocument(Statement{
+			Effect:    EffectAllow,
+			Action:    StringList{"sts:AssumeRole"},
+			Condition: Conditions{"StringEquals": {"sts:ExternalId": StringList{}}},
+		}), "statement 0: condition StringEquals sts:ExternalId has no values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.document.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Validate() = %v, want no error", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("Validate() = %v, want %s", err, tt.err)
+			}
+			if _, jsonErr := tt.document.JSON(); (jsonErr == nil) != (err == nil) {
+				t.Errorf("JSON() = %v, want the Validate error", jsonErr)
+			}
+		})
+	}
+
+	t.Run("extension duplicates a generated sid", func(t *testing.T) {
+		withSpec(&Spec{Policies: map[string]PolicyExtension{
+			LambdaExecutionPolicyName: {Statements: []Statement{
+				{Sid: "Logs", Effect: EffectAllow, Action: StringList{"logs:GetLogEvents"}},
+				{Sid: "Logs", Effect: EffectAllow, Action: StringList{"logs:FilterLogEvents"}},
+			}},
+		}}, func() {
+			// Extension Sids carry their index, so they cannot collide
+			if err := LambdaExecutionPolicy(testLogGroupARN, LambdaPermissions{}).Validate(); err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+		})
+	})
+}
+
+func TestParsePolicyDocument(t *testing.T) {
+	for _, name := range []string{"gateway-trust-snowflake", "api-resource-private-ip-restricted", "merge-shared-extended"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := ParsePolicyDocument(string(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.JSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(data)) != got {
+				t.Errorf("%s does not round trip:\n%s", name, got)
+			}
+		})
+	}
+}
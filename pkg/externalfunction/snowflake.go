@@ -2,103 +2,623 @@ package externalfunction
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	sf "github.com/snowflakedb/gosnowflake"
 	"github.com/tampajohn/goflake/pkg/common"
 )
 
 type SnowflakeConfig struct {
-	*AWSConfig
 	dsn       string
 	sfAccount string
 	sfUser    string
 	sfPass    string
-
-	apiExternalID string
-	apiRoleARN    string
-	iamUserARN    string
+	database  string
+	schema    string
+	role      string
+	warehouse string
+	prompt    common.Prompter
 }
 
-func NewSnowflakeConfig(awsCfg *AWSConfig) *SnowflakeConfig {
-	cfg := &SnowflakeConfig{AWSConfig: awsCfg}
-	if common.AskYesNo("Would you like to us to attempt to use your SNOWFLAKE_[ACCOUNT|USER|PASS] from your environment?") {
+// NewSnowflakeConfig prompts for the Snowflake credentials and the database,
+// role and schema to work in.
+func NewSnowflakeConfig(prompt common.Prompter) *SnowflakeConfig {
+	cfg := &SnowflakeConfig{prompt: prompt}
+	if cfg.prompt.AskYesNo("Would you like to us to attempt to use your SNOWFLAKE_[ACCOUNT|USER|PASS] from your environment?") {
 		// Attempt to get the aws creds from ENV; fail back to prompting the user
-		cfg.sfAccount = common.EnvOrString("SNOWFLAKE_ACCOUNT", false)
-		cfg.sfUser = common.EnvOrString("SNOWFLAKE_USER", false)
-		cfg.sfPass = common.EnvOrString("SNOWFLAKE_PASS", true)
+		cfg.sfAccount = cfg.prompt.EnvOrString("SNOWFLAKE_ACCOUNT", false)
+		cfg.sfUser = cfg.prompt.EnvOrString("SNOWFLAKE_USER", false)
+		cfg.sfPass = cfg.prompt.EnvOrString("SNOWFLAKE_PASS", true)
 	} else {
 		// Just get the creds from the user
-		cfg.sfAccount = common.PromptString("SNOWFLAKE_ACCOUNT", false, "")
-		cfg.sfUser = common.PromptString("SNOWFLAKE_USER", false, "")
-		cfg.sfPass = common.PromptString("SNOWFLAKE_PASS", true, "")
-	}
-
-	database := common.PromptString("What database would you like to use?", false, "")
-	role := common.PromptString("What Snowflake Role do you wish to use (requires ability to create integrations)?", false, "ACCOUNTADMIN")
-	schema := common.PromptString("What schema would you like the external function created in?", false, "PUBLIC")
-
-	dsn, err := sf.DSN(&sf.Config{
-		Account:  cfg.sfAccount,
-		User:     cfg.sfUser,
-		Password: cfg.sfPass,
-		Host:     cfg.sfAccount + ".snowflakecomputing.com",
-		Database: database,
-		Port:     443,
-		Role:     role,
-		Schema:   schema,
-		Protocol: "https",
+		cfg.sfAccount = cfg.prompt.PromptString("SNOWFLAKE_ACCOUNT", false, "")
+		cfg.sfUser = cfg.prompt.PromptString("SNOWFLAKE_USER", false, "")
+		cfg.sfPass = cfg.prompt.PromptString("SNOWFLAKE_PASS", true, "")
+	}
+
+	database := cfg.prompt.PromptString("What database would you like to use?", false, "")
+	role := cfg.prompt.PromptString("What Snowflake Role do you wish to use (requires ability to create integrations)?", false, "ACCOUNTADMIN")
+	schema := cfg.prompt.PromptString("What schema would you like the external function created in?", false, "PUBLIC")
+	warehouse := cfg.prompt.PromptStringWithValidator("What warehouse would you like to use (leave empty for your default)?", false, "", func(s string) error {
+		return nil
 	})
+	cfg.database, cfg.schema, cfg.role, cfg.warehouse = database, schema, role, strings.TrimSpace(warehouse)
+
+	sfCfg := &sf.Config{
+		Account:   cfg.sfAccount,
+		User:      cfg.sfUser,
+		Password:  cfg.sfPass,
+		Host:      cfg.sfAccount + ".snowflakecomputing.com",
+		Database:  database,
+		Port:      443,
+		Role:      role,
+		Schema:    schema,
+		Warehouse: cfg.warehouse,
+		Protocol:  "https",
+	}
+	if overrides.SnowflakeHost != "" {
+		sfCfg.Host = overrides.SnowflakeHost
+	}
+	if overrides.SnowflakePort != 0 {
+		sfCfg.Port = overrides.SnowflakePort
+	}
+	if overrides.SnowflakeProtocol != "" {
+		sfCfg.Protocol = overrides.SnowflakeProtocol
+	}
+	dsn, err := sf.DSN(sfCfg)
+	if err != nil {
+		log.Fatalf("Error encountered: %v", err)
+	}
 
 	cfg.dsn = dsn
 	logger := sf.CreateDefaultLogger()
 	logger.SetLogLevel("panic")
 	sf.SetLogger(&logger)
+	return cfg
+}
 
+// CreateExternalFunction creates the API integration described by p, passes
+// the identity Snowflake will call as back to p to trust, creates the external
+// function against p's endpoint, calls it once and finally grants it to the
+// spec's roles.
+func (cfg *SnowflakeConfig) CreateExternalFunction(p Provider, extFuncName string, extFuncSignature string) error {
+	integration := extFuncName + "_api_integration"
 	var s string
-	err = cfg.executeSnowflakeQuery(fmt.Sprintf(`create or replace api integration %s_api_integration
-	api_provider = aws_api_gateway
-	api_aws_role_arn = '%s'
-	api_allowed_prefixes = ('%s')
-	enabled = true;`,
-		cfg.extFuncName,
-		cfg.EnsureRole(cfg.Resources.gatewayRoleName, TrustDocument),
-		cfg.Resources.gatewayEndpoint), func(scan func(dest ...interface{}) error) error {
+	scan := func(scan func(dest ...interface{}) error) error {
 		return scan(&s)
-	})
+	}
+	err := cfg.executeSnowflakeQuery(p.IntegrationSQL(integration), scan)
 	if err != nil {
-		log.Fatalf("Error encountered: %v", err)
+		return err
+	}
+	err = cfg.executeSnowflakeQuery(p.IntegrationUpdateSQL(integration), scan)
+	if err != nil {
+		return err
+	}
+
+	props, err := cfg.describeIntegration(integration)
+	if err != nil {
+		return err
+	}
+	err = applyTrust(p, props)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.createExternalFunction(extFuncSignature, integration, p.Endpoint())
+	if err != nil {
+		return err
+	}
+
+	err = cfg.SmokeTest(extFuncName, extFuncSignature)
+	if err != nil {
+		return err
+	}
+
+	return cfg.ApplyGrants(extFuncName, extFuncSignature)
+}
+
+// applyTrust restricts p's proxy to Snowflake, as described by the
+// integration's properties.
+func applyTrust(p Provider, props map[string]string) error {
+	switch t := p.(type) {
+	case ConsentTruster:
+		return t.ApplyConsent(props["AZURE_CONSENT_URL"], props["AZURE_MULTI_TENANT_APP_NAME"])
+	case Truster:
+		externalIDProperty, iamUserProperty := t.TrustProperties()
+		return t.ApplyTrust(props[externalIDProperty], props[iamUserProperty])
+	case IdentityTruster:
+		return t.TrustIdentity(props[t.IdentityProperty()])
+	}
+	return fmt.Errorf("%T cannot restrict its proxy to Snowflake", p)
+}
+
+// Smoke test attempts are spread over a minute, long enough for new IAM
+// permissions to propagate.
+const (
+	smokeTestAttempts = 6
+	smokeTestInterval = 10 * time.Second
+)
+
+// SmokeTest calls the function once with sample arguments, retrying while
+// the proxy's permissions propagate, and explains what went wrong if it never
+// succeeds.
+func (cfg *SnowflakeConfig) SmokeTest(extFuncName string, extFuncSignature string) error {
+	var args []string
+	for _, t := range signatureTypes(extFuncSignature) {
+		args = append(args, sampleValue(t))
+	}
+	query := fmt.Sprintf(`select %s(%s);`, extFuncName, strings.Join(args, ", "))
+	for attempt := 1; ; attempt++ {
+		result, err := cfg.queryValue(query)
+		if err == nil {
+			fmt.Printf("Smoke test passed: %s returned %s\n", query, result)
+			return nil
+		}
+		diagnosis, retry := diagnoseSmokeTest(err)
+		if !retry || attempt == smokeTestAttempts {
+			return fmt.Errorf("smoke test %s failed: %v\n%s", query, err, diagnosis)
+		}
+		fmt.Printf("Smoke test failed (attempt %d of %d), retrying in %s...\n", attempt, smokeTestAttempts, smokeTestInterval)
+		time.Sleep(smokeTestInterval)
+	}
+}
+
+var (
+	numberTypes = map[string]bool{"NUMBER": true, "DECIMAL": true, "NUMERIC": true, "INT": true, "INTEGER": true,
+		"BIGINT": true, "SMALLINT": true, "TINYINT": true, "BYTEINT": true, "FLOAT": true, "FLOAT4": true,
+		"FLOAT8": true, "DOUBLE": true, "DOUBLE PRECISION": true, "REAL": true}
+	textTypes = map[string]bool{"VARCHAR": true, "CHAR": true, "CHARACTER": true, "STRING": true, "TEXT": true}
+)
+
+// typeName drops the precision or length from a Snowflake data type, e.g.
+// number(38, 0) is NUMBER.
+func typeName(t string) string {
+	return strings.ToUpper(strings.TrimSpace(strings.Split(t, "(")[0]))
+}
+
+// sampleValue is a literal of the Snowflake data type t, e.g. 1 for
+// number(38, 0).
+func sampleValue(t string) string {
+	name := typeName(t)
+	switch {
+	case numberTypes[name]:
+		return "1"
+	case textTypes[name]:
+		return "'goflake'"
+	}
+	switch name {
+	case "BOOLEAN":
+		return "true"
+	case "DATE":
+		return "current_date()"
+	case "TIME":
+		return "current_time()"
+	case "DATETIME", "TIMESTAMP", "TIMESTAMP_LTZ", "TIMESTAMP_NTZ", "TIMESTAMP_TZ":
+		return "current_timestamp()"
+	case "VARIANT":
+		return `parse_json('{"goflake": 1}')`
+	case "OBJECT":
+		return "object_construct('goflake', 1)"
+	case "ARRAY":
+		return "array_construct(1)"
+	case "BINARY", "VARBINARY":
+		return "to_binary('676f666c616b65', 'HEX')"
+	case "GEOGRAPHY":
+		return "to_geography('POINT(0 0)')"
+	}
+	return "null"
+}
+
+// sampleJSONValue is what Snowflake sends for a value of the data type t;
+// types without a simple JSON form are null.
+func sampleJSONValue(t string) interface{} {
+	name := typeName(t)
+	switch {
+	case numberTypes[name]:
+		return 1
+	case textTypes[name]:
+		return "goflake"
+	case name == "BOOLEAN":
+		return true
+	}
+	return nil
+}
+
+// Numbers of the errors Snowflake reports for a failed external function
+// call.
+const (
+	// sfErrAssumeRole is "Error assuming AWS_ROLE".
+	sfErrAssumeRole = 100324
+	// sfErrRemoteService is "Request failed for external function ... with
+	// remote service error: <HTTP status>".
+	sfErrRemoteService = 100351
+)
+
+// remoteServiceStatus finds the HTTP status in an sfErrRemoteService message.
+var remoteServiceStatus = regexp.MustCompile(`remote service error: (\d{3})`)
+
+// diagnoseSmokeTest explains a failed call and whether it is worth retrying,
+// i.e. whether it may just be permissions that haven't propagated yet.
+func diagnoseSmokeTest(err error) (diagnosis string, retry bool) {
+	var sfErr *sf.SnowflakeError
+	if !errors.As(err, &sfErr) {
+		return "The function could not be called; see the error above.", false
+	}
+	switch sfErr.Number {
+	case sfErrAssumeRole:
+		return "Snowflake could not assume the gateway role. Its trust policy must match the integration's API_AWS_IAM_USER_ARN and API_AWS_EXTERNAL_ID; run repair-trust if the integration was recreated.", true
+	case sfErrRemoteService:
+		status := 0
+		if m := remoteServiceStatus.FindStringSubmatch(sfErr.Message); m != nil {
+			status, _ = strconv.Atoi(m[1])
+		}
+		switch {
+		case status == 403:
+			return "The gateway refused the call (403). Check the role's invoke policy, the REST API's resource policy (allowed IP ranges, VPC endpoints), the web ACL and, if one is required, the API key.", true
+		case status == 401:
+			return "The gateway could not authenticate Snowflake (401). Check the integration's audience and the proxy's authentication settings.", true
+		case status >= 400:
+			return "The call reached the function, which failed. Its logs have the details; the logs command finds them by the batch ID in Snowflake's query history.", false
+		}
+	}
+	return "The function could not be called; see the error above.", false
+}
+
+// ApplyGrants brings USAGE on the function's API integration and on the
+// function in line with the spec's roles, and transfers their ownership when
+// the spec names an owner. Without either in the spec grants are left alone.
+// Ownership is transferred last, once every other grant is made; later runs
+// must use the owner role, or a role it is granted to.
+func (cfg *SnowflakeConfig) ApplyGrants(extFuncName string, extFuncSignature string) error {
+	if spec.Snowflake.UsageRoles == nil && spec.Snowflake.Owner == "" {
+		return nil
+	}
+	objects := []string{
+		"integration " + extFuncName + "_api_integration",
+		fmt.Sprintf("function %s(%s)", extFuncName, signatureArgTypes(extFuncSignature)),
+	}
+	var statements, transfers []string
+	for _, object := range objects {
+		grants, transfer, err := cfg.grantStatements(object)
+		if err != nil {
+			return err
+		}
+		if len(grants) == 0 && transfer == "" {
+			fmt.Printf("Grants on %s are up to date\n", object)
+		}
+		statements = append(statements, grants...)
+		if transfer != "" {
+			transfers = append(transfers, transfer)
+		}
+	}
+	for _, statement := range append(statements, transfers...) {
+		fmt.Println(statement)
+		_, err := cfg.queryRows(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantStatements returns the grants and revokes of USAGE on object the spec
+// calls for, and the statement transferring its ownership if it does.
+func (cfg *SnowflakeConfig) grantStatements(object string) (statements []string, transfer string, err error) {
+	rows, err := cfg.queryRows(fmt.Sprintf(`show grants on %s;`, object))
+	if err != nil {
+		return nil, "", err
+	}
+	granted := map[string]bool{}
+	owner := ""
+	for _, r := range rows {
+		if r["granted_to"] != "ROLE" {
+			continue
+		}
+		switch r["privilege"] {
+		case "USAGE":
+			granted[r["grantee_name"]] = true
+		case "OWNERSHIP":
+			owner = r["grantee_name"]
+		}
+	}
+
+	if spec.Snowflake.UsageRoles != nil {
+		wanted := map[string]bool{}
+		for _, role := range *spec.Snowflake.UsageRoles {
+			role = resolveIdentifier(role)
+			wanted[role] = true
+			if !granted[role] {
+				statements = append(statements, fmt.Sprintf(`grant usage on %s to role %s;`, object, sqlIdentifier(role)))
+			}
+		}
+		var revoked []string
+		for role := range granted {
+			if !wanted[role] {
+				revoked = append(revoked, role)
+			}
+		}
+		sort.Strings(revoked)
+		for _, role := range revoked {
+			statements = append(statements, fmt.Sprintf(`revoke usage on %s from role %s;`, object, sqlIdentifier(role)))
+		}
 	}
-	// fmt.Println(s)
+	if spec.Snowflake.Owner != "" {
+		if role := resolveIdentifier(spec.Snowflake.Owner); role != owner {
+			transfer = fmt.Sprintf(`grant ownership on %s to role %s copy current grants;`, object, sqlIdentifier(role))
+		}
+	}
+	return statements, transfer, nil
+}
+
+// resolveIdentifier is the name Snowflake resolves an identifier to: quoted
+// identifiers are taken as they are, unquoted ones are upper cased.
+func resolveIdentifier(identifier string) string {
+	identifier = strings.TrimSpace(identifier)
+	if len(identifier) >= 2 && strings.HasPrefix(identifier, `"`) && strings.HasSuffix(identifier, `"`) {
+		return strings.Replace(identifier[1:len(identifier)-1], `""`, `"`, -1)
+	}
+	return strings.ToUpper(identifier)
+}
+
+// sqlIdentifier quotes a resolved name as a Snowflake identifier.
+func sqlIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// RepairTrust compares the identity the function's API integration reports
+// with what the proxy trusts, and updates the proxy if they drifted apart.
+func (cfg *SnowflakeConfig) RepairTrust(r TrustRepairer, extFuncName string) error {
+	integration := extFuncName + "_api_integration"
+	props, err := cfg.describeIntegration(integration)
+	if err != nil {
+		return err
+	}
+	externalIDProperty, iamUserProperty := r.TrustProperties()
+	repaired, err := r.RepairTrust(props[externalIDProperty], props[iamUserProperty])
+	if err != nil {
+		return err
+	}
+	if repaired {
+		fmt.Printf("Trust of %s repaired\n", integration)
+	} else {
+		fmt.Printf("Trust of %s is up to date\n", integration)
+	}
+	return nil
+}
+
+// RotateAPIKey creates a new API key, switches the function's integration
+// over to it and only once Snowflake has accepted it retires the old key, so
+// calls keep working throughout.
+func (cfg *SnowflakeConfig) RotateAPIKey(r KeyRotator, extFuncName string) error {
+	key, err := r.NewAPIKey()
+	if err != nil {
+		return err
+	}
+	integration := extFuncName + "_api_integration"
+	_, err = cfg.queryRows(fmt.Sprintf(`alter api integration %s set api_key = %s;`, integration, sqlString(key)))
+	if err != nil {
+		return fmt.Errorf("unable to switch %s to the new API key, the old keys are kept: %v", integration, err)
+	}
+	fmt.Printf("%s now presents the new API key\n", integration)
+	return r.RetireAPIKeys()
+}
 
+// sqlString quotes s as a Snowflake string literal.
+func sqlString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// DetachExternalFunction revokes the trust the function's API integration was
+// given and, if asked to, drops the function and the integration from this
+// Snowflake account. Other accounts sharing the proxy keep working.
+func (cfg *SnowflakeConfig) DetachExternalFunction(r TrustRevoker, extFuncName string, extFuncSignature string) error {
+	integration := extFuncName + "_api_integration"
+	props, err := cfg.describeIntegration(integration)
+	if err != nil {
+		return err
+	}
+	externalIDProperty, iamUserProperty := r.TrustProperties()
+	err = r.RevokeTrust(props[externalIDProperty], props[iamUserProperty])
+	if err != nil {
+		return err
+	}
+
+	if !cfg.prompt.AskYesNo("Would you like to drop the external function and its API integration from this account?") {
+		return nil
+	}
+	var s string
+	scan := func(scan func(dest ...interface{}) error) error {
+		return scan(&s)
+	}
+	err = cfg.executeSnowflakeQuery(fmt.Sprintf(`drop function if exists %s(%s);`, extFuncName, signatureArgTypes(extFuncSignature)), scan)
+	if err != nil {
+		return err
+	}
+	return cfg.executeSnowflakeQuery(fmt.Sprintf(`drop integration if exists %s;`, integration), scan)
+}
+
+// describeIntegration returns the property/value pairs reported by
+// `describe integration` for the named integration.
+func (cfg *SnowflakeConfig) describeIntegration(name string) (map[string]string, error) {
 	type describeResults struct {
 		Property     string
 		PropertyType string
 		Value        string
 		Default      string
 	}
-	err = cfg.executeSnowflakeQuery(fmt.Sprintf(`describe integration %s_api_integration;`, cfg.extFuncName), func(scan func(dest ...interface{}) error) error {
+	props := map[string]string{}
+	err := cfg.executeSnowflakeQuery(fmt.Sprintf(`describe integration %s;`, name), func(scan func(dest ...interface{}) error) error {
 		r := &describeResults{
 			Value:   "",
 			Default: "",
 		}
-		err = scan(&r.Property, &r.PropertyType, &r.Value, &r.Default)
+		err := scan(&r.Property, &r.PropertyType, &r.Value, &r.Default)
 		if err != nil {
 			return err
 		}
-		switch r.Property {
-		case "API_AWS_EXTERNAL_ID":
-			cfg.apiExternalID = r.Value
-		case "API_AWS_ROLE_ARN":
-			cfg.apiRoleARN = r.Value
-		case "API_AWS_IAM_USER_ARN":
-			cfg.iamUserARN = r.Value
+		props[r.Property] = r.Value
+		return nil
+	})
+	return props, err
+}
+
+// createExternalFunction creates (or replaces) the external function with the
+// given signature, proxied through the integration to url.
+func (cfg *SnowflakeConfig) createExternalFunction(signature string, integration string, url string) error {
+	return cfg.executeSnowflakeQuery(fmt.Sprintf(`create or replace external function %s
+    returns variant
+    api_integration = %s
+    as '%s'
+	;`, signature,
+		integration,
+		url), func(scan func(dest ...interface{}) error) error {
+		var s string = ""
+		err := scan(&s)
+		if err != nil {
+			return err
 		}
+		fmt.Print(s)
 		return nil
 	})
-	return cfg
-	// set AWS env variables in this proc
+}
+
+// Preflight checks that the database, schema and a warehouse are usable and
+// that the role can create the integration and the function.
+func (cfg *SnowflakeConfig) Preflight() []Check {
+	rows, err := cfg.queryRows(`select current_role() as r, current_database() as db, current_schema() as sch, current_warehouse() as wh;`)
+	if err == nil && len(rows) == 0 {
+		err = fmt.Errorf("no session")
+	}
+	if err != nil {
+		return []Check{{Name: "Snowflake connection", Err: err}}
+	}
+	session := rows[0]
+	checks := []Check{{Name: "Snowflake connection", Detail: fmt.Sprintf("%s as %s", cfg.sfUser, session["r"])}}
+
+	check := Check{Name: "Snowflake database", Detail: session["db"]}
+	if session["db"] == "" {
+		check.Err = fmt.Errorf("%s does not exist or %s can't use it", cfg.database, cfg.role)
+	}
+	checks = append(checks, check)
+	check = Check{Name: "Snowflake schema", Detail: session["sch"]}
+	if session["sch"] == "" {
+		check.Err = fmt.Errorf("%s does not exist or %s can't use it", cfg.schema, cfg.role)
+	}
+	checks = append(checks, check)
+	check = Check{Name: "Snowflake warehouse", Detail: session["wh"]}
+	if session["wh"] == "" {
+		check.Err = fmt.Errorf("no usable warehouse; name one or give %s a default warehouse", cfg.sfUser)
+	} else if warehouses, err := cfg.queryRows(fmt.Sprintf(`show warehouses like '%s';`, session["wh"])); err != nil {
+		check.Err = err
+	} else if len(warehouses) > 0 {
+		check.Detail += " (" + strings.ToLower(warehouses[0]["state"]) + ")"
+	}
+	checks = append(checks, check)
+
+	grants, err := cfg.roleGrants(session["r"], map[string]bool{})
+	if err != nil {
+		return append(checks, Check{Name: "Snowflake privileges", Err: err})
+	}
+	schema := session["db"] + "." + session["sch"]
+	integration := Check{Name: "Snowflake CREATE INTEGRATION"}
+	function := Check{Name: "Snowflake CREATE FUNCTION", Detail: schema}
+	if strings.EqualFold(session["r"], "ACCOUNTADMIN") || grants["CREATE INTEGRATION ON ACCOUNT"] {
+		integration.Detail = "granted to " + session["r"]
+	} else {
+		integration.Err = fmt.Errorf("%s lacks CREATE INTEGRATION on the account", session["r"])
+	}
+	if !grants["CREATE FUNCTION ON SCHEMA "+strings.ToUpper(schema)] && !grants["OWNERSHIP ON SCHEMA "+strings.ToUpper(schema)] {
+		function.Err = fmt.Errorf("%s lacks CREATE FUNCTION on %s", session["r"], schema)
+	}
+	return append(checks, integration, function)
+}
+
+// roleGrants returns the privileges granted to role and the roles it
+// inherits, as "PRIVILEGE ON KIND NAME".
+func (cfg *SnowflakeConfig) roleGrants(role string, seen map[string]bool) (map[string]bool, error) {
+	grants := map[string]bool{}
+	if seen[role] {
+		return grants, nil
+	}
+	seen[role] = true
+	rows, err := cfg.queryRows(fmt.Sprintf(`show grants to role "%s";`, role))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		name := strings.ToUpper(strings.Replace(r["name"], `"`, "", -1))
+		grants[fmt.Sprintf("%s ON %s %s", r["privilege"], r["granted_on"], name)] = true
+		if r["granted_on"] == "ACCOUNT" {
+			grants[fmt.Sprintf("%s ON ACCOUNT", r["privilege"])] = true
+		}
+		if r["granted_on"] == "ROLE" && r["privilege"] == "USAGE" {
+			inherited, err := cfg.roleGrants(r["name"], seen)
+			if err != nil {
+				return nil, err
+			}
+			for grant := range inherited {
+				grants[grant] = true
+			}
+		}
+	}
+	return grants, nil
+}
+
+// queryRows runs a query and returns its rows keyed by lower case column
+// name, reporting failures to the caller.
+func (cfg *SnowflakeConfig) queryRows(query string) ([]map[string]string, error) {
+	db, err := sql.Open("snowflake", cfg.dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for i, column := range columns {
+			row[strings.ToLower(column)] = values[i].String
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// queryValue runs a query returning a single value. Unlike
+// executeSnowflakeQuery, it reports failures to the caller.
+func (cfg *SnowflakeConfig) queryValue(query string) (string, error) {
+	db, err := sql.Open("snowflake", cfg.dsn)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var v sql.NullString
+	err = db.QueryRow(query).Scan(&v)
+	return v.String, err
 }
 
 func (cfg *SnowflakeConfig) executeSnowflakeQuery(query string, scanner func(func(dest ...interface{}) error) error) error {
@@ -0,0 +1,58 @@
+package externalfunction
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	sf "github.com/snowflakedb/gosnowflake"
+)
+
+func TestSQLString(t *testing.T) {
+	for in, want := range map[string]string{
+		"abc123":     `'abc123'`,
+		"it's":       `'it\'s'`,
+		`back\slash`: `'back\\slash'`,
+		`\'; drop`:   `'\\\'; drop'`,
+	} {
+		if got := sqlString(in); got != want {
+			t.Errorf("sqlString(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	for in, want := range map[string]string{
+		"analyst":         `"ANALYST"`,
+		" Etl ":           `"ETL"`,
+		`"Mixed Case"`:    `"Mixed Case"`,
+		`"say ""hi"""`:    `"say ""hi"""`,
+		`x"; drop role y`: `"X""; DROP ROLE Y"`,
+	} {
+		if got := sqlIdentifier(resolveIdentifier(in)); got != want {
+			t.Errorf("sqlIdentifier(resolveIdentifier(%q)) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestDiagnoseSmokeTest(t *testing.T) {
+	tests := []struct {
+		err       error
+		diagnosis string
+		retry     bool
+	}{
+		{&sf.SnowflakeError{Number: sfErrAssumeRole, SQLState: "P0000", Message: "Error assuming AWS_ROLE."}, "Snowflake could not assume", true},
+		{&sf.SnowflakeError{Number: sfErrRemoteService, SQLState: "P0000", Message: "Request failed for external function ECHO with remote service error: 403 '{}'"}, "The gateway refused", true},
+		{&sf.SnowflakeError{Number: sfErrRemoteService, SQLState: "P0000", Message: "Request failed for external function ECHO with remote service error: 401 '{}'"}, "could not authenticate", true},
+		{&sf.SnowflakeError{Number: sfErrRemoteService, SQLState: "P0000", Message: "Request failed for external function ECHO with remote service error: 502 '{}'"}, "reached the function", false},
+		{fmt.Errorf("wrapped: %w", &sf.SnowflakeError{Number: sfErrRemoteService, Message: "remote service error: 500"}), "reached the function", false},
+		{&sf.SnowflakeError{Number: 2003, SQLState: "42S02", Message: "remote service error: 403 in an unrelated message"}, "could not be called", false},
+		{fmt.Errorf("Error assuming AWS_ROLE"), "could not be called", false},
+	}
+	for _, tt := range tests {
+		diagnosis, retry := diagnoseSmokeTest(tt.err)
+		if !strings.Contains(diagnosis, tt.diagnosis) || retry != tt.retry {
+			t.Errorf("diagnoseSmokeTest(%v) = %q, %v, want %q, %v", tt.err, diagnosis, retry, tt.diagnosis, tt.retry)
+		}
+	}
+}
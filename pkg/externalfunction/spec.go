@@ -0,0 +1,250 @@
+package externalfunction
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Spec is the optional JSON file (--spec) that customises the resources
+// goflake creates beyond what the prompts cover.
+type Spec struct {
+	// Policies extends the generated IAM policies, keyed by policy name
+	// (lambda-trust, lambda-execution, gateway-trust, gateway-invoke,
+	// api-resource).
+	Policies map[string]PolicyExtension `json:"policies,omitempty"`
+	// Lambda configures the AWS lambda beyond its name, runtime and code.
+	Lambda LambdaSpec `json:"lambda,omitempty"`
+	// Gateway configures the AWS REST API.
+	Gateway GatewaySpec `json:"gateway,omitempty"`
+	// Tags are added to every resource goflake creates, e.g. owner,
+	// cost-center and environment.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Monitoring adds alarms and a dashboard for the lambda and REST API.
+	Monitoring MonitoringSpec `json:"monitoring,omitempty"`
+	// Snowflake configures the objects goflake creates in Snowflake.
+	Snowflake SnowflakeSpec `json:"snowflake,omitempty"`
+}
+
+type SnowflakeSpec struct {
+	// UsageRoles are granted USAGE on the API integration and the function,
+	// and USAGE granted to other roles is revoked. Grants are left alone
+	// when it is absent; an empty list revokes them all.
+	UsageRoles *[]string `json:"usageRoles,omitempty"`
+	// Owner takes over ownership of the integration and the function, e.g.
+	// so they needn't be managed as ACCOUNTADMIN. It should be granted to
+	// the role goflake runs as, so re-runs can still alter them.
+	Owner string `json:"owner,omitempty"`
+}
+
+type MonitoringSpec struct {
+	// AlarmTopicARN is the SNS topic alarms notify; no alarms are created
+	// without it.
+	AlarmTopicARN string `json:"alarmTopicArn,omitempty"`
+	// ErrorThreshold is how many lambda errors or throttles, or gateway 4XX
+	// or 5XX responses, in 5 minutes raise an alarm (1 unless set).
+	ErrorThreshold float64 `json:"errorThreshold,omitempty"`
+	// DurationThreshold (ms) for the lambda's p99 duration, 80% of its
+	// timeout unless set.
+	DurationThreshold float64 `json:"durationThreshold,omitempty"`
+	// LatencyThreshold (ms) for the gateway's p99 latency, 25s unless set.
+	LatencyThreshold float64 `json:"latencyThreshold,omitempty"`
+	// Dashboard creates a CloudWatch dashboard for the function.
+	Dashboard bool `json:"dashboard,omitempty"`
+}
+
+type GatewaySpec struct {
+	// AllowedIPRanges denies invocations from outside these CIDR ranges,
+	// e.g. Snowflake's egress addresses.
+	AllowedIPRanges []string `json:"allowedIpRanges,omitempty"`
+	// Stage configures the stage Snowflake calls.
+	Stage StageSpec `json:"stage,omitempty"`
+	// UsagePlan limits calls made with the API key, when one is required.
+	UsagePlan UsagePlanSpec `json:"usagePlan,omitempty"`
+	// Domain serves the stage from a custom domain, so the endpoint survives
+	// the REST API being rebuilt.
+	Domain *DomainSpec `json:"domain,omitempty"`
+	// WAF puts a regional web ACL in front of the stage.
+	WAF *WAFSpec `json:"waf,omitempty"`
+}
+
+type WAFSpec struct {
+	// WebACLARN is an existing web ACL to associate. When empty, goflake
+	// creates one that blocks everything but AllowedIPRanges.
+	WebACLARN string `json:"webAclArn,omitempty"`
+	// AllowedIPRanges are Snowflake's (IPv4) egress ranges; the gateway's
+	// allowedIpRanges are used when empty.
+	AllowedIPRanges []string `json:"allowedIpRanges,omitempty"`
+}
+
+type DomainSpec struct {
+	Name string `json:"name"`
+	// CertificateARN is an ACM certificate for Name in the gateway's region.
+	CertificateARN string `json:"certificateArn"`
+	// BasePath the stage is mapped to; empty maps the domain's root.
+	BasePath string `json:"basePath,omitempty"`
+	// HostedZoneID is the Route 53 zone to point Name at the gateway in;
+	// without it the DNS record is left to you.
+	HostedZoneID string `json:"hostedZoneId,omitempty"`
+}
+
+type UsagePlanSpec struct {
+	// QuotaLimit requests per QuotaPeriod (DAY, WEEK or MONTH).
+	QuotaLimit  int64  `json:"quotaLimit,omitempty"`
+	QuotaPeriod string `json:"quotaPeriod,omitempty"`
+	// RateLimit (requests per second) and BurstLimit throttle the key.
+	RateLimit  float64 `json:"rateLimit,omitempty"`
+	BurstLimit int64   `json:"burstLimit,omitempty"`
+}
+
+type StageSpec struct {
+	// Name of the stage, suggested instead of prod. Commands working on an
+	// existing function use it when the REST API does not record its stage.
+	Name string `json:"name,omitempty"`
+	// ThrottlingRateLimit (requests per second) and ThrottlingBurstLimit
+	// apply to every method; unset means the account's limits.
+	ThrottlingRateLimit  float64 `json:"throttlingRateLimit,omitempty"`
+	ThrottlingBurstLimit int64   `json:"throttlingBurstLimit,omitempty"`
+	// AccessLogGroup is the CloudWatch log group access logs are written
+	// to, created if missing. Access logging is off when empty.
+	AccessLogGroup string `json:"accessLogGroup,omitempty"`
+	// LoggingLevel of execution logs is OFF (the default), ERROR or INFO.
+	LoggingLevel string `json:"loggingLevel,omitempty"`
+	// DataTrace adds full requests and responses to the execution logs.
+	DataTrace bool `json:"dataTrace,omitempty"`
+	// TracingEnabled turns on X-Ray tracing of the stage.
+	TracingEnabled bool              `json:"tracingEnabled,omitempty"`
+	Variables      map[string]string `json:"variables,omitempty"`
+}
+
+type LambdaSpec struct {
+	// MemorySize in MB; lambda's default of 128 is rarely enough for a
+	// batch of rows.
+	MemorySize int64 `json:"memorySize,omitempty"`
+	// Timeout in seconds; lambda's default is 3. API Gateway gives up after
+	// 29 seconds whatever is set here.
+	Timeout     int64             `json:"timeout,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	// Architecture is x86_64 (the default) or arm64.
+	Architecture string `json:"architecture,omitempty"`
+	// Layers are layer version ARNs.
+	Layers []string `json:"layers,omitempty"`
+	// ReservedConcurrency caps (and guarantees) the lambda's concurrent
+	// executions.
+	ReservedConcurrency *int64 `json:"reservedConcurrency,omitempty"`
+	// ProvisionedConcurrency keeps this many executions warm behind the
+	// goflake alias, which the REST API then invokes.
+	ProvisionedConcurrency int64 `json:"provisionedConcurrency,omitempty"`
+	// ArtifactBucket is where local zip files are uploaded to and deployed
+	// from, lifting lambda's 50MB limit on inline code.
+	ArtifactBucket string `json:"artifactBucket,omitempty"`
+	// KMSKeyARN encrypts the lambda's environment variables.
+	KMSKeyARN string `json:"kmsKeyArn,omitempty"`
+	// TracingMode is Active or PassThrough; Active enables X-Ray.
+	TracingMode string         `json:"tracingMode,omitempty"`
+	VPC         *LambdaVPCSpec `json:"vpc,omitempty"`
+	// ManagedPolicyARNs are attached to the lambda's role for the handler's
+	// own needs (S3, DynamoDB, ...).
+	ManagedPolicyARNs []string `json:"managedPolicyArns,omitempty"`
+	// LogRetentionDays is how long the lambda's logs are kept, 30 days
+	// unless set; it must be one of the periods CloudWatch Logs offers.
+	LogRetentionDays int64 `json:"logRetentionDays,omitempty"`
+	// LogKMSKeyARN encrypts the lambda's log group.
+	LogKMSKeyARN string `json:"logKmsKeyArn,omitempty"`
+}
+
+// logRetentionDays are the retention periods CloudWatch Logs accepts.
+var logRetentionDays = []int64{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1827, 3653}
+
+type LambdaVPCSpec struct {
+	SubnetIDs        []string `json:"subnetIds"`
+	SecurityGroupIDs []string `json:"securityGroupIds"`
+}
+
+var spec = &Spec{}
+
+// LoadSpec reads the spec at path; it applies to everything goflake creates
+// afterwards.
+func LoadSpec(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s := &Spec{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
+	}
+	for name, ext := range s.Policies {
+		if len(ext.Statements) > 0 {
+			if err := NewPolicyDocument(ext.Statements...).Validate(); err != nil {
+				return fmt.Errorf("policies.%s: %s", name, err)
+			}
+		}
+	}
+	if err := s.Lambda.validate(); err != nil {
+		return err
+	}
+	if d := s.Gateway.Domain; d != nil && (d.Name == "" || d.CertificateARN == "") {
+		return fmt.Errorf("gateway.domain: name and certificateArn are required")
+	}
+	if s.Gateway.UsagePlan.QuotaLimit != 0 {
+		switch s.Gateway.UsagePlan.QuotaPeriod {
+		case "DAY", "WEEK", "MONTH":
+		default:
+			return fmt.Errorf("gateway.usagePlan.quotaPeriod: %q is not DAY, WEEK or MONTH", s.Gateway.UsagePlan.QuotaPeriod)
+		}
+	}
+	if m := s.Monitoring; m.ErrorThreshold < 0 || m.DurationThreshold < 0 || m.LatencyThreshold < 0 {
+		return fmt.Errorf("monitoring: thresholds can't be negative")
+	}
+	if roles := s.Snowflake.UsageRoles; roles != nil {
+		for _, role := range *roles {
+			if strings.TrimSpace(role) == "" {
+				return fmt.Errorf("snowflake.usageRoles: role names can't be empty")
+			}
+		}
+	}
+	switch s.Gateway.Stage.LoggingLevel {
+	case "", "OFF", "ERROR", "INFO":
+	default:
+		return fmt.Errorf("gateway.stage.loggingLevel: %q is not OFF, ERROR or INFO", s.Gateway.Stage.LoggingLevel)
+	}
+	for key := range s.Tags {
+		if strings.HasPrefix(key, "goflake:") {
+			return fmt.Errorf("tags.%s: the goflake: prefix is reserved", key)
+		}
+	}
+	spec = s
+	return nil
+}
+
+func (l LambdaSpec) validate() error {
+	switch l.Architecture {
+	case "", "x86_64", "arm64":
+	default:
+		return fmt.Errorf("lambda.architecture: %q is neither x86_64 nor arm64", l.Architecture)
+	}
+	if l.MemorySize != 0 && (l.MemorySize < 128 || l.MemorySize > 10240) {
+		return fmt.Errorf("lambda.memorySize: %d is not between 128 and 10240", l.MemorySize)
+	}
+	if l.Timeout < 0 || l.Timeout > 900 {
+		return fmt.Errorf("lambda.timeout: %d is not between 1 and 900", l.Timeout)
+	}
+	if l.ProvisionedConcurrency < 0 {
+		return fmt.Errorf("lambda.provisionedConcurrency: %d is negative", l.ProvisionedConcurrency)
+	}
+	if l.ReservedConcurrency != nil && *l.ReservedConcurrency < l.ProvisionedConcurrency {
+		return fmt.Errorf("lambda.reservedConcurrency: %d is less than the provisioned concurrency", *l.ReservedConcurrency)
+	}
+	if l.LogRetentionDays != 0 {
+		valid := false
+		for _, days := range logRetentionDays {
+			valid = valid || days == l.LogRetentionDays
+		}
+		if !valid {
+			return fmt.Errorf("lambda.logRetentionDays: %d is not one of %v", l.LogRetentionDays, logRetentionDays)
+		}
+	}
+	return nil
+}